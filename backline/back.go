@@ -4,84 +4,220 @@
 package main
 
 import (
+    "bufio"
     "bytes"
+    "flag"
     "fmt"
+    "io"
     "net"
+    "net/http"
     "os"
     "strings"
+    "sync"
+    "sync/atomic"
     "time"
 
+    "frontline/lib/accesslog"
+    "frontline/lib/admin"
+    "frontline/lib/auth"
+    "frontline/lib/config"
     "frontline/lib/connection"
+    "frontline/lib/egress"
     "frontline/lib/log"
     "frontline/lib/msg"
+    "frontline/lib/pac"
+    "frontline/lib/ratelimit"
+    "frontline/lib/stats"
     "frontline/lib/supplyline"
 
     "github.com/hshimamoto/go-session"
 )
 
-func waitHTTPConnect(conn net.Conn) (string, error) {
-    buf := make([]byte, 256)
-    n, err := conn.Read(buf)
+// requestError is answered with status before the client is closed.
+type requestError struct {
+    status int
+    err error
+}
+
+func (e *requestError)Error() string {
+    return fmt.Sprintf("%d %s: %v", e.status, http.StatusText(e.status), e.err)
+}
+
+// writeResponse sends a response without body, header lines end with CRLF.
+func writeResponse(conn net.Conn, status int, header string) {
+    fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%sConnection: close\r\nContent-Length: 0\r\n\r\n",
+	status, http.StatusText(status), header)
+}
+
+// connReader reads from conn and keeps the last read error.
+type connReader struct {
+    conn net.Conn
+    err error
+}
+
+func (r *connReader)Read(p []byte) (int, error) {
+    n, err := r.conn.Read(p)
     if err != nil {
-	log.Printf("Read: %v\n", err)
-	return "", err
+	r.err = err
     }
-    for {
-	if n >= 256 {
-	    log.Println("header too long")
-	    return "", fmt.Errorf("request header too long")
+    return n, err
+}
+
+// waitHTTPConnect reads the CONNECT request after the first bytes already
+// read. The header must fit in maxHeader bytes and arrive before the read
+// deadline of conn. Bytes read past the header, like a pipelined TLS
+// ClientHello, are returned to be sent first.
+func waitHTTPConnect(conn net.Conn, first []byte, maxHeader int) (*http.Request, []byte, error) {
+    cr := &connReader{ conn: conn }
+    lr := &io.LimitedReader{ R: io.MultiReader(bytes.NewReader(first), cr), N: int64(maxHeader) }
+    br := bufio.NewReader(lr)
+    req, err := http.ReadRequest(br)
+    if err != nil {
+	// a line cut by the deadline is parsed as it is
+	if operr, ok := cr.err.(net.Error); ok && operr.Timeout() {
+	    return nil, nil, &requestError{ http.StatusRequestTimeout, cr.err }
 	}
-	if bytes.Index(buf, []byte{13, 10, 13, 10}) > 0 {
-	    break
+	if lr.N == 0 {
+	    return nil, nil, &requestError{ http.StatusRequestHeaderFieldsTooLarge, err }
 	}
-	r, err := conn.Read(buf[n:n+1])
-	if err != nil {
-	    log.Printf("Read: %v\n", err)
-	    return "", err
+	if err == io.EOF {
+	    return nil, nil, err
 	}
-	if r == 0 {
-	    log.Println("no Read\n")
-	    return "", fmt.Errorf("no Read")
+	return nil, nil, &requestError{ http.StatusBadRequest, err }
+    }
+    if req.Method != http.MethodConnect {
+	return nil, nil, &requestError{ http.StatusMethodNotAllowed, fmt.Errorf("method %s", req.Method) }
+    }
+    // authority form, [::1]:443 for IPv6
+    host, port, err := net.SplitHostPort(req.RequestURI)
+    if err != nil || host == "" || port == "" {
+	return nil, nil, &requestError{ http.StatusBadRequest, fmt.Errorf("bad target %s", req.RequestURI) }
+    }
+    early, _ := br.Peek(br.Buffered())
+    return req, append([]byte{}, early...), nil
+}
+
+// relay copies between client and dest limited by rate as a tunnel until
+// both sides are done and returns the bytes from and to the client.
+func relay(client, dest net.Conn, rate *ratelimit.Set) (int64, int64) {
+    halfClose := func(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+	    tc.CloseWrite()
+	} else {
+	    c.Close()
 	}
-	n += r
     }
-    lines := strings.Split(string(buf[:n]), "\r\n")
-    w := strings.Split(lines[0], " ")
-    if len(w) < 3 {
-	log.Println("bad request")
-	return "", fmt.Errorf("bad request")
+    copy := func(dst, src net.Conn) int64 {
+	buf := make([]byte, 32 * 1024)
+	var n int64
+	for {
+	    r, err := src.Read(buf)
+	    if r > 0 {
+		rate.Wait(r)
+		w, werr := dst.Write(buf[:r])
+		n += int64(w)
+		if werr != nil {
+		    break
+		}
+	    }
+	    if err != nil {
+		break
+	    }
+	}
+	halfClose(dst)
+	return n
+    }
+    done := make(chan int64)
+    go func() {
+	done <- copy(dest, client)
+    }()
+    down := copy(client, dest)
+    up := <-done
+    return up, down
+}
+
+// authenticate checks Proxy-Authorization and returns the user name. The
+// name is empty when the header is missing and "unknown" for users not in
+// the file to keep the metric labels bounded.
+func authenticate(cred *auth.Credentials, header http.Header) (string, bool) {
+    v := header.Get("Proxy-Authorization")
+    if v == "" {
+	return "", false
+    }
+    user, pass, ok := auth.ParseBasic(v)
+    if !ok {
+	return "unknown", false
     }
-    if w[0] != "CONNECT" {
-	log.Printf("uknown request method %s\n", w[0])
-	return "", fmt.Errorf("unknown request method %s", w[0])
+    return checkUser(cred, user, pass)
+}
+
+// checkUser checks the password of user, "unknown" is returned for a user
+// not in the file.
+func checkUser(cred *auth.Credentials, user, pass string) (string, bool) {
+    if !cred.Has(user) {
+	return "unknown", false
     }
-    return w[1], nil
+    return user, cred.Check(user, pass)
 }
 
 type SupplyLine struct {
+    // guards front and cfg which are replaced on reload, and the state of
+    // the link shared with the Connect goroutines
+    mu sync.Mutex
     front string
+    // sent in LinkCommand
+    name string
+    cfg *config.Config
+    limiter *ratelimit.Limiter
+    serv *connection.Server
+    // replaced by renew, read them with link
     cm *msg.ConnectionManager
     q_req chan []byte
+    // Connects between acquire and release
     connecting int
     live bool
+    // when the supply line started
+    linked time.Time
+    // capabilities of frontline, 0 until it answers LinkCommand, read
+    // with peerCaps
+    caps int32
+    // frontline is going away
+    goaway bool
+    shutdown bool
+    // split direct tunnels, drained with the supply line
+    directs map[net.Conn]bool
 }
 
 func NewSupplyLine(front string) *SupplyLine {
+    hostname, err := os.Hostname()
+    if err != nil {
+	log.Warnf("unable to get hostname: %v", err)
+	hostname = "Unknown"
+    }
     s := &SupplyLine{
 	front: front,
+	name: fmt.Sprintf("%s-%d", hostname, os.Getpid()),
     }
     s.cm = msg.NewConnectionManager()
     s.q_req = make(chan []byte, 256)
     s.connecting = 0
     s.live = false
+    s.directs = map[net.Conn]bool{}
     return s
 }
 
 func (s *SupplyLine)HandleLink(cmd *msg.LinkCommand) {
+    log.NewTag("link", "peer", s.frontline()).With("caps", cmd.Caps).Debugf("frontline capabilities")
+    atomic.StoreInt32(&s.caps, int32(cmd.Caps))
+    s.cm.SetPeerCaps(cmd.Caps)
+}
+
+func (s *SupplyLine)peerCaps() int {
+    return int(atomic.LoadInt32(&s.caps))
 }
 
 func (s *SupplyLine)HandleKeepalive(cmd *msg.KeepaliveCommand) {
-    log.Printf("keep alive %v\n", cmd.T)
+    log.NewTag("keepalive").Debugf("keep alive %v", cmd.T)
 }
 
 func (s *SupplyLine)HandleConnect(cmd *msg.ConnectCommand) {
@@ -104,146 +240,630 @@ func (s *SupplyLine)HandleDataAck(cmd *msg.DataAckCommand) {
     s.cm.Queue(cmd)
 }
 
+func (s *SupplyLine)HandleGoaway(cmd *msg.GoawayCommand) {
+    log.NewTag("link", "peer", s.frontline()).Printf("frontline is going away")
+    s.mu.Lock()
+    s.goaway = true
+    s.mu.Unlock()
+}
+
+func (s *SupplyLine)Priority(connId int) int {
+    cm, _ := s.link()
+    return cm.Priority(connId)
+}
+
+// config returns the configuration, a connection uses the same one from
+// start to end.
+func (s *SupplyLine)config() *config.Config {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.cfg
+}
+
+func (s *SupplyLine)frontline() string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.front
+}
+
+// link returns the connection slots and queue of the supply line.
+func (s *SupplyLine)link() (*msg.ConnectionManager, chan []byte) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.cm, s.q_req
+}
+
+// state returns whether the link is up, frontline is going away and
+// backline is shutting down.
+func (s *SupplyLine)state() (live, goaway, shutdown bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.live, s.goaway, s.shutdown
+}
+
+// acquire returns the slots and queue of a live link for a Connect, renew
+// and Clean wait for it until release.
+func (s *SupplyLine)acquire() (*msg.ConnectionManager, chan []byte, time.Time, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if !s.live {
+	return nil, nil, time.Time{}, false
+    }
+    s.connecting++
+    return s.cm, s.q_req, s.linked, true
+}
+
+func (s *SupplyLine)release() {
+    s.mu.Lock()
+    s.connecting--
+    s.mu.Unlock()
+}
+
+// waitConnecting waits until the Connects have opened their slots or given
+// up, a later Cancel reaches them.
+func (s *SupplyLine)waitConnecting() {
+    for {
+	s.mu.Lock()
+	n := s.connecting
+	s.mu.Unlock()
+	if n == 0 {
+	    return
+	}
+	time.Sleep(time.Millisecond * 100)
+    }
+}
+
+// addDirect counts a split direct tunnel, false when shutting down.
+func (s *SupplyLine)addDirect(conn net.Conn) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.shutdown {
+	return false
+    }
+    s.directs[conn] = true
+    return true
+}
+
+func (s *SupplyLine)removeDirect(conn net.Conn) {
+    s.mu.Lock()
+    delete(s.directs, conn)
+    s.mu.Unlock()
+}
+
+// drainDirect waits for the direct tunnels until deadline and closes the
+// rest.
+func (s *SupplyLine)drainDirect(deadline time.Time) {
+    for {
+	s.mu.Lock()
+	n := len(s.directs)
+	s.mu.Unlock()
+	if n == 0 || time.Now().After(deadline) {
+	    break
+	}
+	time.Sleep(time.Millisecond * 200)
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for conn := range s.directs {
+	log.NewTag("drain", "client", fmt.Sprintf("%v", conn.RemoteAddr())).Printf("close direct")
+	conn.Close()
+    }
+}
+
+// prepare returns the switch of the running supply line to n on reload,
+// backline has nothing more to load.
+func (s *SupplyLine)prepare(n *config.Config) (func(), error) {
+    return func() {
+	s.mu.Lock()
+	s.front = n.Frontline
+	s.cfg = n
+	s.mu.Unlock()
+    }, nil
+}
+
+func (s *SupplyLine)Status() string {
+    live, goaway, _ := s.state()
+    if live {
+	if goaway {
+	    return "going away"
+	}
+	return "up"
+    }
+    return "down"
+}
+
+func (s *SupplyLine)registerAdmin() {
+    cm, _ := s.link()
+    admin.Register(&admin.Link{
+	Name: "frontline",
+	Peer: s.frontline,
+	Status: s.Status,
+	CM: cm,
+    })
+}
+
+// renew replaces connection slots after a planned close of the supply line
+// so that the next one can start without waiting for the old connections.
+func (s *SupplyLine)renew() {
+    // a Connect still opening a slot of the old ones is canceled by Clean
+    s.waitConnecting()
+    s.mu.Lock()
+    cm, q_req := s.cm, s.q_req
+    s.cm = msg.NewConnectionManager()
+    s.q_req = make(chan []byte, 256)
+    s.mu.Unlock()
+    s.registerAdmin()
+    // drop what old connections still send
+    done := make(chan bool)
+    go func() {
+	for {
+	    select {
+	    case <-q_req:
+	    case <-done:
+		return
+	    }
+	}
+    }()
+    go func() {
+	cm.Clean()
+	close(done)
+    }()
+}
+
+// Shutdown stops accepting, tells frontline and waits for the connections.
+func (s *SupplyLine)Shutdown() {
+    log.Println("shutdown: stop accepting")
+    s.mu.Lock()
+    s.shutdown = true
+    live := s.live
+    s.mu.Unlock()
+    s.serv.Close()
+    deadline := time.Now().Add(s.config().DrainTimeout.Duration)
+    if live {
+	cm, q_req := s.link()
+	supplyline.Drain(cm, q_req, s.peerCaps(), deadline)
+    }
+    s.drainDirect(deadline)
+    log.Println("shutdown: done")
+}
+
 func (s *SupplyLine)main(conn net.Conn) {
-    tag := log.NewTag("Unknown")
+    tag := log.NewTag("link", "peer", "Unknown")
     if tcp, ok := conn.(*net.TCPConn); ok {
-	tag = log.NewTag(fmt.Sprintf("%v", tcp.RemoteAddr()))
+	tag = log.NewTag("link", "peer", fmt.Sprintf("%v", tcp.RemoteAddr()))
     }
-    tag.Printf("start main\n")
+    tag.Debugf("start main")
 
-    tag.Printf("connected to frontline\n")
+    tag.Printf("connected to frontline")
 
-    hostname, err := os.Hostname()
-    if err != nil {
-	tag.Printf("unable to get hostname: %v\n", err)
-	hostname = "Unknown"
-    }
-    cmd := msg.PackedLinkCommand(fmt.Sprintf("%s-%d", hostname, os.Getpid()))
+    cmd := msg.PackedLinkCommand(s.name)
     if _, err := conn.Write(cmd); err != nil {
-	tag.Printf("send command error: %v\n", err)
+	tag.Errorf("send command error: %v", err)
 	return
     }
 
     // now link is established, start receiver
+    atomic.StoreInt32(&s.caps, 0)
+    s.mu.Lock()
+    s.goaway = false
+    s.linked = time.Now()
     s.live = true
-    supplyline.Main(conn, s, s.q_req)
+    cm, q_req := s.cm, s.q_req
+    s.mu.Unlock()
+    supplyline.Main(conn, s, q_req)
+    s.mu.Lock()
     s.live = false
+    s.mu.Unlock()
 
-    tag.Printf("disconnected from frontline\n")
+    tag.Printf("disconnected from frontline")
+
+    if _, goaway, shutdown := s.state(); goaway && !shutdown {
+	// planned, reconnect without waiting
+	s.renew()
+	tag.Debugf("end main")
+	return
+    }
 
     // wait a bit before Clean
     time.Sleep(time.Second)
-    s.cm.Clean()
-
-    // wait
-    if s.connecting > 0 {
-	tag.Printf("wait finish waiting connection\n")
-	for s.connecting > 0 {
-	    time.Sleep(time.Second)
-	}
-    }
+    tag.Debugf("wait finish waiting connection")
+    s.waitConnecting()
+    cm.Clean()
 
     time.Sleep(time.Second * 3)
 
-    tag.Printf("end main\n")
+    tag.Debugf("end main")
 }
 
 func (s *SupplyLine)Run() {
+    first := true
     for {
-	if conn, err := session.Dial(s.front); err == nil {
+	if _, _, shutdown := s.state(); shutdown {
+	    break
+	}
+	if !first {
+	    stats.Counter("reconnects_total").Inc()
+	}
+	first = false
+	front := s.frontline()
+	if conn, err := session.Dial(front); err == nil {
+	    if err := connection.EnableKeepAlive(conn); err != nil {
+		log.Warnf("enable keepalive: %v", err)
+	    }
 	    s.main(conn)
 	    conn.Close()
+	    if _, goaway, _ := s.state(); goaway {
+		continue
+	    }
 	} else {
-	    log.Printf("SupplyLine %s: %v\n", s.front, err)
+	    log.NewTag("link", "peer", front).Warnf("dial: %v", err)
 	}
 	// interval
 	time.Sleep(time.Second)
     }
 }
 
+// direct dials hostport from backline for a split direct destination.
+func (s *SupplyLine)direct(conf *config.Config, conn net.Conn, socks bool, hostport string, early []byte, entry *accesslog.Entry, tag *log.Tag) {
+    defer conn.Close()
+    entry.Route = "direct"
+    d := &egress.Dialer{
+	Timeout: conf.ConnectTimeout.Duration,
+	AttemptTimeout: conf.AttemptTimeout.Duration,
+	Resolver: conf.Resolver(),
+    }
+    dest, err := d.Dial(hostport, nil)
+    if err != nil {
+	tag.Warnf("direct: %v", err)
+	if socks {
+	    conn.Write(socksReply(socksStatus(http.StatusBadGateway)))
+	} else {
+	    writeResponse(conn, http.StatusBadGateway, "")
+	}
+	stats.Counter("connect_failures_total", "reason", "dial").Inc()
+	entry.Result = "dial"
+	entry.Finish(time.Now())
+	accesslog.Write(entry)
+	return
+    }
+    defer dest.Close()
+    entry.Addr = fmt.Sprintf("%v", dest.RemoteAddr())
+    tag.With("addr", entry.Addr).Printf("connected direct")
+    if socks {
+	conn.Write(socksReply(socksSucceeded))
+    } else {
+	conn.Write(msg.HTTPReply(true, ""))
+    }
+    rate := s.limiter.For(hostport)
+    var sent int64
+    if len(early) > 0 {
+	rate.Wait(len(early))
+	if _, err := dest.Write(early); err != nil {
+	    tag.Warnf("direct: %v", err)
+	}
+	sent = int64(len(early))
+    }
+    up, down := relay(conn, dest, rate)
+    entry.Result = "ok"
+    entry.BytesUp = sent + up
+    entry.BytesDown = down
+    entry.Finish(time.Now())
+    accesslog.Write(entry)
+}
+
 func (s *SupplyLine)Connect(conn net.Conn) {
-    log.Println("accept new stream")
+    client := fmt.Sprintf("%v", conn.RemoteAddr())
+    tag := log.NewTag("proxy", "client", client)
+    tag.Debugf("accept new stream")
+    entry := &accesslog.Entry{
+	Start: time.Now(),
+	Client: client,
+	Backline: s.name,
+    }
+    reject := func(reason string) {
+	stats.Counter("connect_failures_total", "reason", reason).Inc()
+	conn.Close()
+	entry.Result = reason
+	accesslog.Write(entry)
+    }
 
     if err := connection.EnableKeepAlive(conn); err != nil {
-	log.Printf("enable keepalive: %v\n", err)
+	tag.Warnf("enable keepalive: %v", err)
     }
-    hostport, err := waitHTTPConnect(conn)
+    conf := s.config()
+    // one deadline from accept for the whole request
+    conn.SetReadDeadline(time.Now().Add(conf.HeaderTimeout.Duration))
+    // SOCKS5 starts with its version, CONNECT with a letter
+    first := make([]byte, 1)
+    _, err := io.ReadFull(conn, first)
     if err != nil {
-	conn.Close()
+	tag.Debugf("request: %v", err)
+	reject("bad_request")
 	return
     }
-    log.Printf("CONNECT %s\n", hostport)
+    socks := first[0] == socksVersion
+    hostport, user, result := "", "", ""
+    var early []byte
+    if socks {
+	hostport, user, result, err = waitSocksConnect(conn, conf.Credentials())
+	if err != nil {
+	    reason := "bad_request"
+	    if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		reason = "timeout"
+	    }
+	    tag.Warnf("request: %v", err)
+	    reject(reason)
+	    return
+	}
+    } else {
+	var req *http.Request
+	req, early, err = waitHTTPConnect(conn, first, conf.MaxHeaderSize)
+	if err != nil {
+	    reason := "bad_request"
+	    if rerr, ok := err.(*requestError); ok {
+		if rerr.status == http.StatusRequestTimeout {
+		    reason = "timeout"
+		}
+		header := ""
+		if rerr.status == http.StatusMethodNotAllowed {
+		    header = "Allow: CONNECT\r\n"
+		}
+		writeResponse(conn, rerr.status, header)
+	    }
+	    tag.Warnf("request: %v", err)
+	    reject(reason)
+	    return
+	}
+	hostport = req.RequestURI
+	if cred := conf.Credentials(); cred != nil {
+	    var ok bool
+	    user, ok = authenticate(cred, req.Header)
+	    result = "ok"
+	    if !ok {
+		result = "invalid"
+		if user == "" {
+		    result = "missing"
+		}
+		writeResponse(conn, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"backline\"\r\n")
+	    }
+	}
+    }
+    conn.SetReadDeadline(time.Time{})
+    if hostport != "" {
+	entry.HostPort = hostport
+	tag = tag.With("hostport", hostport)
+    }
+    if result != "" {
+	stats.Counter("proxy_auth_total", "user", user, "result", result).Inc()
+	if result != "ok" {
+	    tag.With("user", user).Warnf("proxy authentication %s", result)
+	    reject("auth")
+	    return
+	}
+	entry.User = user
+	tag = tag.With("user", user)
+    }
+    if socks {
+	tag.Printf("SOCKS CONNECT")
+    } else {
+	tag.Printf("CONNECT")
+    }
 
-    if !s.live {
-	conn.Close()
-	log.Println("no link")
+    action, rule := conf.SplitRoute(hostport)
+    stats.Counter("split_total", "action", action).Inc()
+    if rule >= 0 {
+	tag = tag.With("split", action, "rule", conf.Split[rule].String())
+	tag.Printf("split route")
+    }
+    switch action {
+    case "reject":
+	if socks {
+	    conn.Write(socksReply(socksStatus(http.StatusForbidden)))
+	} else {
+	    writeResponse(conn, http.StatusForbidden, "")
+	}
+	reject("denied")
+	return
+    case "direct":
+	if !s.addDirect(conn) {
+	    reject("shutdown")
+	    tag.Warnf("shutting down")
+	    return
+	}
+	s.direct(conf, conn, socks, hostport, early, entry, tag)
+	s.removeDirect(conn)
+	return
+    }
+
+    // wait for the next supply line if frontline is going away
+    t := time.Now().Add(time.Minute)
+    for {
+	_, goaway, shutdown := s.state()
+	if !goaway || shutdown || time.Now().After(t) {
+	    break
+	}
+	time.Sleep(time.Millisecond * 100)
+    }
+    if _, _, shutdown := s.state(); shutdown {
+	reject("shutdown")
+	tag.Warnf("shutting down")
 	return
     }
-    s.connecting++
     // keep ConnectionManager at this moment
-    cm := s.cm
+    cm, q_req, linked, ok := s.acquire()
+    if !ok {
+	reject("no_link")
+	tag.Warnf("no link")
+	return
+    }
     c := cm.GetFree()
-    t := time.Now().Add(time.Minute)
+    t = time.Now().Add(time.Minute)
     for c == nil {
-	if !s.live || time.Now().After(t) {
-	    log.Println("no free connection slot")
-	    s.connecting--
-	    conn.Close()
+	if live, _, _ := s.state(); !live || time.Now().After(t) {
+	    tag.Warnf("no free connection slot")
+	    s.release()
+	    reject("no_slot")
 	    return
 	}
 	time.Sleep(time.Second)
 	c = cm.GetFree()
     }
-    s.connecting--
-    if !s.live {
-	log.Println("no link")
+    if live, _, _ := s.state(); !live {
+	cm.PutFree(c)
+	s.release()
+	reject("no_link")
+	tag.Warnf("no link")
 	return
     }
 
-    // mark it used
-    c.Used = true
-    c.FlushQ()
+    // mark it used, a Clean from now on cancels it
+    err = c.Open()
+    s.release()
+    if err != nil {
+	tag.Warnf("%v", err)
+	cm.PutFree(c)
+	reject("no_slot")
+	return
+    }
+    var reply func(bool, string) []byte
+    if socks {
+	reply = socksAck
+    }
+    c.Configure(s.limiter.For(hostport), conf.Priority(hostport), reply)
+    c.SetEarlyData(early)
 
     cmd := msg.PackedConnectCommand(c.Id, hostport)
-    s.q_req <- cmd
+    if entry.User != "" {
+	// frontline answers LinkCommand at once, an old one never does
+	for s.peerCaps() == 0 && time.Since(linked) < time.Second {
+	    time.Sleep(time.Millisecond * 50)
+	}
+	if s.peerCaps() & msg.CapConnectUser != 0 {
+	    cmd = msg.PackedConnectExCommand(c.Id, hostport, entry.User)
+	}
+    }
+    q_req <- cmd
 
     go func() {
-	c.Run(hostport, conn, s.q_req)
+	c.Run(hostport, conn, q_req)
 	conn.Close()
+	info := c.Info()
+	entry.Result = "ok"
+	if !c.Connected() {
+	    entry.Result = "rejected"
+	    if info.Reason != "" {
+		entry.Result = info.Reason
+	    }
+	}
+	entry.Addr = info.PeerAddr
+	entry.BytesUp = info.BytesIn
+	entry.BytesDown = info.BytesOut
+	entry.Finish(c.End)
+	accesslog.Write(entry)
 	c.Free(func(){
 	    // back to free
 	    cm.PutFree(c)
-	    log.Printf("connection %d back to freelist\n", c.Id)
+	    tag.Debugf("connection %d back to freelist", c.Id)
 	})
     }()
 }
 
 func main() {
     log.Setup("backline")
+    stats.Setup("backline")
 
-    if len(os.Args) < 2 {
-	log.Println("backline <frontline> [listen]")
+    cfg, err := config.Parse("backline", os.Args[1:])
+    if err != nil {
+	if err != flag.ErrHelp {
+	    log.Errorf("config: %v", err)
+	    log.Println("backline [options] <frontline> [listen]")
+	    os.Exit(1)
+	}
 	return
     }
-
-    listen := ":8443"
-    front := os.Args[1]
-    if len(os.Args) > 2 {
-	listen = os.Args[2]
+    if cfg.HashPassword() {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+	    log.Errorf("read password: %v", err)
+	    os.Exit(1)
+	}
+	h, err := auth.Hash(strings.TrimRight(line, "\r\n"))
+	if err != nil {
+	    log.Errorf("hash password: %v", err)
+	    os.Exit(1)
+	}
+	fmt.Println(h)
+	return
+    }
+    if cfg.Check() {
+	log.Println("config ok")
+	return
     }
+    if err := cfg.Apply(); err != nil {
+	log.Errorf("config: %v", err)
+	os.Exit(1)
+    }
+
+    listen := cfg.Listen
+    front := cfg.Frontline
 
     log.Printf("start front %s listen %s", front, listen)
 
     s := NewSupplyLine(front)
+    s.cfg = cfg
+    l, err := cfg.Limiter()
+    if err != nil {
+	log.Errorf("rate limit: %v", err)
+	os.Exit(1)
+    }
+    s.limiter = l
+    go stats.Report(time.Minute)
+    stats.Help("reconnects_total", "Reconnects to frontline.")
+    stats.Help("free_slots", "Free connection slots.")
+    stats.Help("split_total", "CONNECT requests by split route action (direct, tunnel, reject).")
+    stats.GaugeFunc("free_slots", func() float64 {
+	cm, _ := s.link()
+	return float64(cm.FreeCount())
+    })
+    s.registerAdmin()
+    if cfg.Admin != "" {
+	go func() {
+	    log.Errorf("admin: %v", admin.Serve(cfg.Admin))
+	}()
+    }
+    if cfg.Metrics != "" {
+	go func() {
+	    log.Errorf("metrics: %v", stats.Serve(cfg.Metrics))
+	}()
+    }
+    if cfg.PAC.Listen != "" {
+	go func() {
+	    log.Errorf("pac: %v", pac.Serve(cfg.PAC.Listen))
+	}()
+    }
 
-    serv, err := session.NewServer(listen, s.Connect)
+    serv, err := connection.NewServer(listen, s.Connect)
     if err != nil {
-	log.Printf("NewServer: %v\n", err)
+	log.Errorf("NewServer: %v", err)
 	return
     }
+    serv.SetACL(cfg.ACL())
+    s.serv = serv
+    r := &config.Reloader{
+	Cmd: "backline",
+	Limiter: s.limiter,
+	Server: serv,
+	Current: s.config,
+	Prepare: s.prepare,
+    }
+    admin.SetReload(r.Reload)
+    config.HandleReload(r.Reload)
+    config.HandleShutdown(s.Shutdown)
 
     // now we can start to communicate with frontline
     go s.Run()
 
     serv.Run()
+    // closed by shutdown, it exits the process
+    select {}
 }
@@ -0,0 +1,113 @@
+// HTTP frontline / backline
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package main
+
+import (
+    "io"
+    "net"
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+)
+
+// httpConnect runs waitHTTPConnect after the first byte of what the client
+// sends, the client stays open until the request is read.
+func httpConnect(t *testing.T, maxHeader int, timeout time.Duration, send ...string) (*http.Request, []byte, error) {
+    server, client := net.Pipe()
+    defer client.Close()
+    defer server.Close()
+    server.SetReadDeadline(time.Now().Add(timeout))
+    go func() {
+	for _, s := range send {
+	    if _, err := io.WriteString(client, s); err != nil {
+		return
+	    }
+	}
+    }()
+    first := make([]byte, 1)
+    if _, err := io.ReadFull(server, first); err != nil {
+	t.Fatalf("first byte: %v", err)
+    }
+    return waitHTTPConnect(server, first, maxHeader)
+}
+
+// status returns the status answered for err, 0 when there is none.
+func status(err error) int {
+    if rerr, ok := err.(*requestError); ok {
+	return rerr.status
+    }
+    return 0
+}
+
+func TestWaitHTTPConnect(t *testing.T) {
+    tests := []struct {
+	req string
+	target string
+	status int
+    }{
+	{ "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n", "example.com:443", 0 },
+	{ "CONNECT [2001:db8::1]:443 HTTP/1.1\r\n\r\n", "[2001:db8::1]:443", 0 },
+	{ "CONNECT 192.0.2.1:80 HTTP/1.0\r\n\r\n", "192.0.2.1:80", 0 },
+	// frontline would dial itself
+	{ "CONNECT :443 HTTP/1.1\r\n\r\n", "", http.StatusBadRequest },
+	{ "CONNECT []:443 HTTP/1.1\r\n\r\n", "", http.StatusBadRequest },
+	{ "CONNECT example.com HTTP/1.1\r\n\r\n", "", http.StatusBadRequest },
+	{ "CONNECT example.com: HTTP/1.1\r\n\r\n", "", http.StatusBadRequest },
+	{ "CONNECT 2001:db8::1:443 HTTP/1.1\r\n\r\n", "", http.StatusBadRequest },
+	{ "GET http://example.com/ HTTP/1.1\r\n\r\n", "", http.StatusMethodNotAllowed },
+	{ "CONNECT\r\n\r\n", "", http.StatusBadRequest },
+    }
+    for _, tt := range tests {
+	req, _, err := httpConnect(t, 4096, time.Second * 2, tt.req)
+	if tt.status != 0 {
+	    if got := status(err); got != tt.status {
+		t.Errorf("%q: status %d, want %d (%v)", tt.req, got, tt.status, err)
+	    }
+	    continue
+	}
+	if err != nil {
+	    t.Errorf("%q: %v", tt.req, err)
+	    continue
+	}
+	if req.RequestURI != tt.target {
+	    t.Errorf("%q: target %q", tt.req, req.RequestURI)
+	}
+    }
+}
+
+func TestWaitHTTPConnectLimits(t *testing.T) {
+    long := "CONNECT example.com:443 HTTP/1.1\r\nX-Pad: " + strings.Repeat("a", 200) + "\r\n\r\n"
+    if _, _, err := httpConnect(t, 128, time.Second * 2, long); status(err) != http.StatusRequestHeaderFieldsTooLarge {
+	t.Errorf("oversized header: %v", err)
+    }
+    if _, _, err := httpConnect(t, len(long), time.Second * 2, long); err != nil {
+	t.Errorf("header of the limit: %v", err)
+    }
+    // the header never ends
+    start := time.Now()
+    _, _, err := httpConnect(t, 4096, time.Millisecond * 200, "CONNECT example.com:443 HTTP/1.1\r\nHost: exa")
+    if status(err) != http.StatusRequestTimeout {
+	t.Errorf("slow header: %v", err)
+    }
+    if d := time.Since(start); d > time.Second {
+	t.Errorf("timed out after %v", d)
+    }
+}
+
+func TestWaitHTTPConnectEarlyData(t *testing.T) {
+    // a client sending its ClientHello without waiting for the answer
+    hello := "\x16\x03\x01\x00\x05hello"
+    req, early, err := httpConnect(t, 4096, time.Second * 2, "CONNECT example.com:443 HTTP/1.1\r\n\r\n" + hello)
+    if err != nil {
+	t.Fatal(err)
+    }
+    if req.RequestURI != "example.com:443" || string(early) != hello {
+	t.Errorf("got %q, early %q", req.RequestURI, early)
+    }
+    _, early, err = httpConnect(t, 4096, time.Second * 2, "CONNECT example.com:443 HTTP/1.1\r\n\r\n")
+    if err != nil || len(early) != 0 {
+	t.Errorf("early %q, %v", early, err)
+    }
+}
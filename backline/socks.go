@@ -0,0 +1,147 @@
+// HTTP frontline / backline
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "strconv"
+
+    "frontline/lib/auth"
+)
+
+// SOCKS5 (RFC 1928) on the listener of CONNECT, with username/password
+// authentication (RFC 1929) when auth is set.
+const (
+    socksVersion = 5
+    socksNoAuth = 0
+    socksUserPass = 2
+    socksNoMethod = 0xff
+    socksConnect = 1
+    // reply codes
+    socksSucceeded = 0
+    socksFailure = 1
+    socksNotAllowed = 2
+    socksHostUnreachable = 4
+    socksCommandNotSupported = 7
+    socksAddressNotSupported = 8
+)
+
+// socksReply answers the request, the bound address is not told.
+func socksReply(code byte) []byte {
+    return []byte{ socksVersion, code, 0, 1, 0, 0, 0, 0, 0, 0 }
+}
+
+// socksStatus maps the HTTP status of a refused request to a reply code.
+func socksStatus(status int) byte {
+    switch status {
+    case http.StatusForbidden:
+	return socksNotAllowed
+    case http.StatusBadGateway:
+	return socksHostUnreachable
+    }
+    return socksFailure
+}
+
+// socksAck answers the ConnectAck of frontline.
+func socksAck(ok bool, reason string) []byte {
+    if ok {
+	return socksReply(socksSucceeded)
+    }
+    switch reason {
+    case "quota", "denied":
+	return socksReply(socksNotAllowed)
+    case "dial":
+	return socksReply(socksHostUnreachable)
+    }
+    return socksReply(socksFailure)
+}
+
+// waitSocksConnect reads the greeting after the version byte and the
+// CONNECT request before the read deadline of conn. With cred the client
+// must send a user in cred, result is the authentication result as in
+// authenticate and the request is not read after a failure.
+func waitSocksConnect(conn net.Conn, cred *auth.Credentials) (hostport, user, result string, err error) {
+    buf := make([]byte, 256)
+    read := func(n int) []byte {
+	if err == nil {
+	    _, err = io.ReadFull(conn, buf[:n])
+	}
+	return buf[:n]
+    }
+    methods := read(int(read(1)[0]))
+    if err != nil {
+	return
+    }
+    method := byte(socksNoAuth)
+    if cred != nil {
+	method = socksUserPass
+    }
+    if bytes.IndexByte(methods, method) < 0 {
+	conn.Write([]byte{ socksVersion, socksNoMethod })
+	if cred != nil {
+	    return "", "", "missing", nil
+	}
+	return "", "", "", fmt.Errorf("socks: no acceptable method")
+    }
+    conn.Write([]byte{ socksVersion, method })
+    if cred != nil {
+	// version 1, user and password
+	if v := read(1)[0]; err == nil && v != 1 {
+	    return "", "", "", fmt.Errorf("socks: bad auth version %d", v)
+	}
+	name := string(read(int(read(1)[0])))
+	pass := string(read(int(read(1)[0])))
+	if err != nil {
+	    return
+	}
+	var ok bool
+	user, ok = checkUser(cred, name, pass)
+	if !ok {
+	    conn.Write([]byte{ 1, 1 })
+	    return "", user, "invalid", nil
+	}
+	conn.Write([]byte{ 1, 0 })
+	result = "ok"
+    }
+    // version, command, reserved and address type
+    req := append([]byte{}, read(4)...)
+    if err != nil {
+	return
+    }
+    if req[0] != socksVersion {
+	return "", "", "", fmt.Errorf("socks: bad version %d", req[0])
+    }
+    if req[1] != socksConnect {
+	conn.Write(socksReply(socksCommandNotSupported))
+	return "", "", "", fmt.Errorf("socks: command %d", req[1])
+    }
+    host := ""
+    switch req[3] {
+    case 1:
+	host = net.IP(read(4)).String()
+    case 3:
+	host = string(read(int(read(1)[0])))
+    case 4:
+	host = net.IP(read(16)).String()
+    default:
+	conn.Write(socksReply(socksAddressNotSupported))
+	return "", "", "", fmt.Errorf("socks: address type %d", req[3])
+    }
+    p := read(2)
+    if err != nil {
+	return
+    }
+    // as the empty host of CONNECT, frontline would dial itself
+    port := int(p[0]) << 8 | int(p[1])
+    if host == "" || port == 0 {
+	conn.Write(socksReply(socksAddressNotSupported))
+	return "", "", "", fmt.Errorf("socks: bad target %s", net.JoinHostPort(host, strconv.Itoa(port)))
+    }
+    hostport = net.JoinHostPort(host, strconv.Itoa(port))
+    return hostport, user, result, nil
+}
@@ -0,0 +1,147 @@
+// HTTP frontline / backline
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package main
+
+import (
+    "bytes"
+    "io"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "frontline/lib/auth"
+)
+
+// socksExchange runs waitSocksConnect against a client sending send and
+// returns what the client read with its results.
+func socksExchange(t *testing.T, cred *auth.Credentials, send ...[]byte) ([]byte, string, string, string, error) {
+    server, client := net.Pipe()
+    defer client.Close()
+    server.SetDeadline(time.Now().Add(time.Second * 2))
+    go func() {
+	for _, b := range send {
+	    if _, err := client.Write(b); err != nil {
+		return
+	    }
+	}
+    }()
+    replies := make(chan []byte)
+    go func() {
+	b, _ := io.ReadAll(client)
+	replies <- b
+    }()
+    hostport, user, result, err := waitSocksConnect(server, cred)
+    server.Close()
+    return <-replies, hostport, user, result, err
+}
+
+// socksRequest is a CONNECT request for the address of type atyp.
+func socksRequest(atyp byte, addr []byte, port int) []byte {
+    req := append([]byte{ socksVersion, socksConnect, 0, atyp }, addr...)
+    return append(req, byte(port >> 8), byte(port))
+}
+
+// socksDomain is a domain with its length.
+func socksDomain(host string) []byte {
+    return append([]byte{ byte(len(host)) }, host...)
+}
+
+// socksUser is the RFC 1929 sub-negotiation.
+func socksUser(user, pass string) []byte {
+    b := append([]byte{ 1, byte(len(user)) }, user...)
+    b = append(b, byte(len(pass)))
+    return append(b, pass...)
+}
+
+func TestSocksConnect(t *testing.T) {
+    noAuth := []byte{ 1, socksNoAuth }
+    tests := []struct {
+	req []byte
+	hostport string
+	reply []byte
+    }{
+	{ socksRequest(3, socksDomain("example.com"), 443), "example.com:443", nil },
+	{ socksRequest(1, []byte{ 192, 0, 2, 1 }, 80), "192.0.2.1:80", nil },
+	{ socksRequest(4, net.ParseIP("2001:db8::1"), 443), "[2001:db8::1]:443", nil },
+	// frontline would dial itself
+	{ socksRequest(3, socksDomain(""), 443), "", socksReply(socksAddressNotSupported) },
+	{ socksRequest(3, socksDomain("example.com"), 0), "", socksReply(socksAddressNotSupported) },
+	{ socksRequest(5, nil, 443), "", socksReply(socksAddressNotSupported) },
+	{ []byte{ socksVersion, 2, 0, 1, 192, 0, 2, 1, 0, 80 }, "", socksReply(socksCommandNotSupported) },
+    }
+    for _, tt := range tests {
+	reply, hostport, _, _, err := socksExchange(t, nil, noAuth, tt.req)
+	if hostport != tt.hostport || (err == nil) != (tt.hostport != "") {
+	    t.Errorf("%v: got %q, %v", tt.req, hostport, err)
+	}
+	want := append([]byte{ socksVersion, socksNoAuth }, tt.reply...)
+	if !bytes.Equal(reply, want) {
+	    t.Errorf("%v: reply %v, want %v", tt.req, reply, want)
+	}
+    }
+}
+
+func TestSocksUserPass(t *testing.T) {
+    defer func(n int) { auth.Iterations = n }(auth.Iterations)
+    auth.Iterations = 1000
+    h, err := auth.Hash("secret")
+    if err != nil {
+	t.Fatal(err)
+    }
+    path := filepath.Join(t.TempDir(), "auth")
+    if err := os.WriteFile(path, []byte("alice:" + h + "\n"), 0600); err != nil {
+	t.Fatal(err)
+    }
+    cred, err := auth.Load(path)
+    if err != nil {
+	t.Fatal(err)
+    }
+    req := socksRequest(3, socksDomain("example.com"), 443)
+    userPass := []byte{ 2, socksNoAuth, socksUserPass }
+    tests := []struct {
+	send [][]byte
+	hostport, user, result string
+	reply []byte
+    }{
+	{
+	    [][]byte{ userPass, socksUser("alice", "secret"), req },
+	    "example.com:443", "alice", "ok",
+	    []byte{ socksVersion, socksUserPass, 1, 0 },
+	},
+	{
+	    [][]byte{ userPass, socksUser("alice", "secret2"), req },
+	    "", "alice", "invalid",
+	    []byte{ socksVersion, socksUserPass, 1, 1 },
+	},
+	{
+	    [][]byte{ userPass, socksUser("bob", "secret"), req },
+	    "", "unknown", "invalid",
+	    []byte{ socksVersion, socksUserPass, 1, 1 },
+	},
+	// no user offered
+	{
+	    [][]byte{ { 1, socksNoAuth }, req },
+	    "", "", "missing",
+	    []byte{ socksVersion, socksNoMethod },
+	},
+    }
+    for i, tt := range tests {
+	reply, hostport, user, result, err := socksExchange(t, cred, tt.send...)
+	if err != nil {
+	    t.Errorf("%d: %v", i, err)
+	}
+	if hostport != tt.hostport || user != tt.user || result != tt.result {
+	    t.Errorf("%d: got %q, %q, %q", i, hostport, user, result)
+	}
+	if !bytes.Equal(reply, tt.reply) {
+	    t.Errorf("%d: reply %v, want %v", i, reply, tt.reply)
+	}
+    }
+    // a bad version of the sub-negotiation
+    if _, _, _, _, err := socksExchange(t, cred, userPass, []byte{ 5, 5 }, []byte("alice")); err == nil {
+	t.Errorf("auth version 5 accepted")
+    }
+}
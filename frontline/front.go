@@ -4,22 +4,113 @@
 package main
 
 import (
+    "flag"
     "fmt"
     "net"
     "os"
+    "sync"
+    "sync/atomic"
     "time"
 
+    "frontline/lib/accesslog"
+    "frontline/lib/admin"
+    "frontline/lib/config"
     "frontline/lib/connection"
+    "frontline/lib/egress"
     "frontline/lib/log"
     "frontline/lib/msg"
+    "frontline/lib/quota"
+    "frontline/lib/ratelimit"
+    "frontline/lib/stats"
     "frontline/lib/supplyline"
+)
 
-    "github.com/hshimamoto/go-session"
+// shared by all supply lines
+var (
+    // replaced on reload, read them with current
+    cfgLock sync.Mutex
+    cfg *config.Config
+    // bounds concurrent dials
+    dials chan bool
+    limiter *ratelimit.Limiter
+    serv *connection.Server
+    quotas = quota.NewManager()
+    // running supply lines
+    lines = map[*SupplyLine]bool{}
+    linesLock sync.Mutex
+    // set on shutdown, read with atomic
+    draining int32
 )
 
+// current returns the configuration and the dial pool, a connection uses
+// the same ones from start to end.
+func current() (*config.Config, chan bool) {
+    cfgLock.Lock()
+    defer cfgLock.Unlock()
+    return cfg, dials
+}
+
+// shutdown stops accepting and drains all supply lines.
+func shutdown() {
+    log.Println("shutdown: stop accepting")
+    atomic.StoreInt32(&draining, 1)
+    serv.Close()
+    conf, _ := current()
+    deadline := time.Now().Add(conf.DrainTimeout.Duration)
+    linesLock.Lock()
+    list := []*SupplyLine{}
+    for s := range lines {
+	list = append(list, s)
+    }
+    linesLock.Unlock()
+    var wg sync.WaitGroup
+    for _, s := range list {
+	wg.Add(1)
+	go func(s *SupplyLine) {
+	    supplyline.Drain(s.cm, s.q_req, s.peerCaps(), deadline)
+	    wg.Done()
+	}(s)
+    }
+    wg.Wait()
+    if err := quotas.Save(); err != nil {
+	log.Errorf("quota: %v", err)
+    }
+    log.Println("shutdown: done")
+}
+
+// prepare loads the quota state of n on reload and returns the switch to
+// n, running supply lines are kept.
+func prepare(n *config.Config) (func(), error) {
+    st, err := quotas.Stage(&n.Quotas)
+    if err != nil {
+	return nil, err
+    }
+    old, pool := current()
+    if n.MaxDials != old.MaxDials {
+	// running dials finish with the old pool
+	pool = make(chan bool, n.MaxDials)
+    }
+    return func() {
+	quotas.Apply(st)
+	cfgLock.Lock()
+	cfg, dials = n, pool
+	cfgLock.Unlock()
+    }, nil
+}
+
 type SupplyLine struct {
     cm *msg.ConnectionManager
     q_req chan []byte
+    // guards peer which the admin API reads
+    mu sync.Mutex
+    // name of the backline from LinkCommand, read with backline
+    peer string
+    // backline identity by its address, for sources and quotas
+    ident string
+    // capabilities of the backline, read with peerCaps
+    caps int32
+    // address of the backline
+    addr string
 }
 
 func NewSupplyLine() *SupplyLine {
@@ -30,40 +121,214 @@ func NewSupplyLine() *SupplyLine {
 }
 
 func (s *SupplyLine)HandleLink(cmd *msg.LinkCommand) {
+    log.NewTag("link").With("caps", cmd.Caps).Printf("link from %s", cmd.Client)
+    s.mu.Lock()
+    s.peer = cmd.Client
+    s.mu.Unlock()
+    atomic.StoreInt32(&s.caps, int32(cmd.Caps))
+    s.cm.SetPeerCaps(cmd.Caps)
+    if cmd.Caps != 0 {
+	// tell what this side supports, an old backline never asks
+	s.q_req <- msg.PackedLinkCommand("frontline")
+    }
+}
+
+func (s *SupplyLine)peerCaps() int {
+    return int(atomic.LoadInt32(&s.caps))
+}
+
+// backline returns the name of the backline.
+func (s *SupplyLine)backline() string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.peer
 }
 
 func (s *SupplyLine)HandleKeepalive(cmd *msg.KeepaliveCommand) {
-    log.Printf("keep alive %v\n", cmd.T)
+    log.NewTag("keepalive", "peer", s.backline()).Debugf("keep alive %v", cmd.T)
 }
 
 func (s *SupplyLine)HandleConnect(cmd *msg.ConnectCommand) {
     c := s.cm.Get(cmd.ConnId)
-    if c.Used {
+    if c.State() != msg.Idle {
 	// Ignore
 	return
     }
-    c.Used = true
-    c.FlushQ()
+    peer := s.backline()
+    tag := log.NewTag("conn", "conn", cmd.ConnId, "hostport", cmd.HostPort, "peer", peer)
+    if cmd.User != "" {
+	tag = tag.With("user", cmd.User)
+    }
+    entry := &accesslog.Entry{
+	Start: time.Now(),
+	Client: s.addr,
+	Backline: peer,
+	User: cmd.User,
+	HostPort: cmd.HostPort,
+    }
+    if atomic.LoadInt32(&draining) != 0 {
+	tag.Warnf("shutting down")
+	stats.Counter("connect_failures_total", "reason", "shutdown").Inc()
+	s.q_req <- s.connectAck(cmd, false, "shutdown: draining")
+	entry.Result = "shutdown"
+	accesslog.Write(entry)
+	return
+    }
+    if err := c.Open(); err != nil {
+	return
+    }
+    conf, pool := current()
+    c.Configure(limiter.For(cmd.HostPort), conf.Priority(cmd.HostPort), nil)
+
+    // dial in background, the link keeps running
+    go s.dial(conf, pool, c, cmd, tag, entry)
+}
+
+// account counts the bytes of c while it runs and cancels it when a byte
+// quota is reached. It tells on over whether it did once stop is closed.
+func (s *SupplyLine)account(c *msg.Connection, ticket *quota.Ticket, tag *log.Tag, stop <-chan bool, over chan<- bool) {
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+    for {
+	select {
+	case <-stop:
+	    over <- false
+	    return
+	case <-ticker.C:
+	    in, out := c.Bytes()
+	    if err := quotas.Use(ticket, in + out); err != nil {
+		tag.Warnf("%v, disconnect", err)
+		c.Cancel()
+		<-stop
+		over <- true
+		return
+	    }
+	}
+    }
+}
+
+// connectAck answers cmd, the address or reason only to a backline which
+// knows ConnectAckEx.
+func (s *SupplyLine)connectAck(cmd *msg.ConnectCommand, ok bool, addr string) []byte {
+    if s.peerCaps() & msg.CapConnectAckAddr != 0 {
+	return msg.PackedConnectAckExCommand(cmd, ok, addr)
+    }
+    return msg.PackedConnectAckCommand(cmd, ok)
+}
 
+// release gives back a connection refused before Run.
+func release(c *msg.Connection, tag *log.Tag) {
+    c.Transition(msg.Closing)
+    c.Free(func(){
+	tag.Debugf("freed")
+    })
+}
+
+// dial connects to the destination and answers with ConnectAck.
+func (s *SupplyLine)dial(conf *config.Config, pool chan bool, c *msg.Connection, cmd *msg.ConnectCommand, tag *log.Tag, entry *accesslog.Entry) {
     hostport := cmd.HostPort
+    route := conf.Route(hostport)
+    stats.Counter("egress_total", "route", route.Action).Inc()
+    if route.Action == "deny" {
+	tag.Warnf("denied by route %s", route.Pattern)
+	stats.Counter("connect_failures_total", "reason", "denied").Inc()
+	s.q_req <- s.connectAck(cmd, false, "denied: route " + route.Pattern)
+	release(c, tag)
+	entry.Result = "denied"
+	accesslog.Write(entry)
+	return
+    }
+    ticket, err := quotas.Acquire(s.ident, cmd.User)
+    if err != nil {
+	tag.Warnf("%v", err)
+	stats.Counter("connect_failures_total", "reason", "quota").Inc()
+	s.q_req <- s.connectAck(cmd, false, err.Error())
+	release(c, tag)
+	entry.Result = "quota"
+	accesslog.Write(entry)
+	return
+    }
+    // the wait for a slot of max_dials counts in connect_timeout
+    deadline := time.Now().Add(conf.ConnectTimeout.Duration)
+    timer := time.NewTimer(conf.ConnectTimeout.Duration)
+    slot := false
+    select {
+    case pool <- true:
+	slot = true
+	timer.Stop()
+    case <-timer.C:
+    }
+    left := time.Until(deadline)
+    if !slot || left <= 0 {
+	if slot {
+	    <-pool
+	}
+	tag.Warnf("no dial slot in %v", conf.ConnectTimeout.Duration)
+	stats.Counter("connect_failures_total", "reason", "dial").Inc()
+	s.q_req <- s.connectAck(cmd, false, "dial: timeout")
+	quotas.Release(ticket, 0)
+	release(c, tag)
+	entry.Result = "dial"
+	accesslog.Write(entry)
+	return
+    }
+    active := stats.Gauge("dials_active")
+    active.Inc()
     // try to connect
-    lconn, err := session.Dial(hostport)
+    d := &egress.Dialer{
+	Timeout: left,
+	AttemptTimeout: conf.AttemptTimeout.Duration,
+	Source: conf.EgressSource(s.ident, hostport),
+	Resolver: conf.Resolver(),
+    }
+    lconn, err := d.Dial(hostport, route.ProxyURL())
+    active.Dec()
+    <-pool
     if err != nil {
-	log.Printf("Connection %d: Dial: %v\n", cmd.ConnId, err)
-	s.q_req <- msg.PackedConnectAckCommand(cmd, false)
-	c.Used = false
+	tag.Warnf("Dial: %v", err)
+	stats.Counter("connect_failures_total", "reason", "dial").Inc()
+	s.q_req <- s.connectAck(cmd, false, "dial: " + err.Error())
+	quotas.Release(ticket, 0)
+	release(c, tag)
+	entry.Result = "dial"
+	accesslog.Write(entry)
 	return
     }
-    log.Printf("connected to %s\n", hostport)
-    s.q_req <- msg.PackedConnectAckCommand(cmd, true)
+    if route.Action == "proxy" {
+	// the proxy resolved it
+	entry.Addr = route.ProxyURL().Scheme + "://" + route.ProxyURL().Host
+	tag = tag.With("proxy", route.ProxyURL().Host)
+    } else {
+	entry.Addr = fmt.Sprintf("%v", lconn.RemoteAddr())
+    }
+    tag = tag.With("addr", entry.Addr)
+    if d.Source != nil {
+	tag = tag.With("source", fmt.Sprintf("%v", lconn.LocalAddr()))
+    }
+    entry.Result = "ok"
+    tag.Printf("connected")
+    stats.Counter("connects_total").Inc()
+    s.q_req <- s.connectAck(cmd, true, entry.Addr)
+    c.Transition(msg.Established)
 
-    go func () {
-	c.Run(hostport, lconn, s.q_req)
-	lconn.Close()
-	c.Free(func(){
-	    log.Printf("connection %d freed\n", c.Id)
-	})
-    }()
+    stop := make(chan bool)
+    over := make(chan bool, 1)
+    go s.account(c, ticket, tag, stop, over)
+    c.Run(hostport, lconn, s.q_req)
+    lconn.Close()
+    close(stop)
+    if <-over {
+	entry.Result = "quota"
+    }
+    info := c.Info()
+    entry.BytesUp = info.BytesOut
+    entry.BytesDown = info.BytesIn
+    quotas.Release(ticket, info.BytesIn + info.BytesOut)
+    entry.Finish(c.End)
+    accesslog.Write(entry)
+    c.Free(func(){
+	tag.Debugf("freed")
+    })
 }
 
 func (s *SupplyLine)HandleConnectAck(cmd *msg.ConnectAckCommand) {
@@ -82,47 +347,143 @@ func (s *SupplyLine)HandleDataAck(cmd *msg.DataAckCommand) {
     s.cm.Queue(cmd)
 }
 
+func (s *SupplyLine)HandleGoaway(cmd *msg.GoawayCommand) {
+    log.NewTag("link", "peer", s.backline()).Printf("backline is going away")
+}
+
+func (s *SupplyLine)Priority(connId int) int {
+    return s.cm.Priority(connId)
+}
+
 func (s *SupplyLine)Run(conn net.Conn) {
-    tag := log.NewTag("Unknown")
+    peer := "Unknown"
     if tcp, ok := conn.(*net.TCPConn); ok {
-	tag = log.NewTag(fmt.Sprintf("%v", tcp.RemoteAddr()))
+	peer = fmt.Sprintf("%v", tcp.RemoteAddr())
     }
-    tag.Printf("start main\n")
+    s.addr = peer
+    conf, _ := current()
+    s.ident = conf.BacklineIdentity(peer)
+    tag := log.NewTag("link", "peer", peer, "backline", s.ident)
+    tag.Debugf("start main")
 
-    tag.Printf("connected from backline\n")
+    stats.GaugeFunc("free_slots", func() float64 {
+	return float64(s.cm.FreeCount())
+    }, "peer", peer)
+    defer stats.Remove("free_slots", "peer", peer)
+    link := &admin.Link{
+	Name: peer,
+	Peer: s.backline,
+	Status: func() string { return "up" },
+	CM: s.cm,
+    }
+    admin.Register(link)
+    defer admin.Unregister(link)
+
+    tag.Printf("connected from backline")
+    linesLock.Lock()
+    lines[s] = true
+    linesLock.Unlock()
+    defer func() {
+	linesLock.Lock()
+	delete(lines, s)
+	linesLock.Unlock()
+    }()
     supplyline.Main(conn, s, s.q_req)
-    tag.Printf("disconnected from backline\n")
+    tag.Printf("disconnected from backline")
 
     s.cm.Clean()
     time.Sleep(time.Second * 3)
 
-    tag.Printf("end main\n")
+    tag.Debugf("end main")
 }
 
 func main() {
     log.Setup("frontline")
+    stats.Setup("frontline")
 
-    listen := ":8443"
-    if len(os.Args) > 1 {
-	listen = os.Args[1]
+    c, err := config.Parse("frontline", os.Args[1:])
+    if err != nil {
+	if err != flag.ErrHelp {
+	    log.Errorf("config: %v", err)
+	    log.Println("frontline [options] [listen]")
+	    os.Exit(1)
+	}
+	return
+    }
+    if c.Check() {
+	log.Println("config ok")
+	return
+    }
+    if err := c.Apply(); err != nil {
+	log.Errorf("config: %v", err)
+	os.Exit(1)
     }
+    listen := c.Listen
 
     log.Printf("start listen %s", listen)
 
-    serv, err := session.NewServer(listen, func(conn net.Conn) {
+    limiter, err = c.Limiter()
+    if err != nil {
+	log.Errorf("rate limit: %v", err)
+	os.Exit(1)
+    }
+    if err := quotas.Configure(&c.Quotas); err != nil {
+	log.Errorf("quota: %v", err)
+	os.Exit(1)
+    }
+    go func() {
+	for range time.Tick(time.Minute) {
+	    if err := quotas.Save(); err != nil {
+		log.Errorf("quota: %v", err)
+	    }
+	}
+    }()
+    cfg, dials = c, make(chan bool, c.MaxDials)
+    go stats.Report(time.Minute)
+    stats.Help("free_slots", "Free connection slots.")
+    stats.Help("dials_active", "Dials to destinations in progress.")
+    stats.Help("egress_total", "Connects by egress route.")
+    if c.Admin != "" {
+	go func() {
+	    log.Errorf("admin: %v", admin.Serve(c.Admin))
+	}()
+    }
+    if c.Metrics != "" {
+	go func() {
+	    log.Errorf("metrics: %v", stats.Serve(c.Metrics))
+	}()
+    }
+
+    serv, err = connection.NewServer(listen, func(conn net.Conn) {
 	defer conn.Close()
-	log.Println("connected")
+	log.Debugf("connected")
 	if err := connection.EnableKeepAlive(conn); err != nil {
-	    log.Printf("enable keepalive: %v\n", err)
+	    log.Warnf("enable keepalive: %v", err)
 	}
 	// new SupplyLine
 	s := NewSupplyLine()
 	s.Run(conn)
-	log.Println("close connection")
+	log.Debugf("close connection")
     })
     if err != nil {
-	log.Printf("NewServer: %v\n", err)
+	log.Errorf("NewServer: %v", err)
 	return
     }
+    serv.SetACL(c.ACL())
+    r := &config.Reloader{
+	Cmd: "frontline",
+	Limiter: limiter,
+	Server: serv,
+	Current: func() *config.Config {
+	    c, _ := current()
+	    return c
+	},
+	Prepare: prepare,
+    }
+    admin.SetReload(r.Reload)
+    config.HandleReload(r.Reload)
+    config.HandleShutdown(shutdown)
     serv.Run()
+    // closed by shutdown, it exits the process
+    select {}
 }
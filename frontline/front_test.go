@@ -0,0 +1,175 @@
+// HTTP frontline / frontline
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package main
+
+import (
+    "net"
+    "strings"
+    "testing"
+    "time"
+
+    "frontline/lib/accesslog"
+    "frontline/lib/config"
+    "frontline/lib/log"
+    "frontline/lib/msg"
+)
+
+// silentProxy accepts connections for an upstream proxy which never
+// answers CONNECT, a dial through it waits until it is closed or times out.
+func silentProxy(t *testing.T) (string, chan net.Conn) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+	t.Fatalf("Listen: %v", err)
+    }
+    t.Cleanup(func() { l.Close() })
+    accepted := make(chan net.Conn, 16)
+    go func() {
+	for {
+	    conn, err := l.Accept()
+	    if err != nil {
+		return
+	    }
+	    accepted <- conn
+	}
+    }()
+    return l.Addr().String(), accepted
+}
+
+// testLine returns a supply line to a backline which knows ConnectAckEx
+// and a configuration routing everything through proxy.
+func testLine(t *testing.T, proxy string, args ...string) (*SupplyLine, *config.Config) {
+    args = append(args, "-route", "*=http://" + proxy)
+    conf, err := config.Parse("frontline", args)
+    if err != nil {
+	t.Fatalf("Parse: %v", err)
+    }
+    s := NewSupplyLine()
+    s.caps = msg.CapConnectAckAddr
+    return s, conf
+}
+
+// startDial opens connection id and dials in background as HandleConnect.
+func startDial(t *testing.T, s *SupplyLine, conf *config.Config, pool chan bool, id int) {
+    c := s.cm.Get(id)
+    if err := c.Open(); err != nil {
+	t.Fatalf("Open %d: %v", id, err)
+    }
+    cmd := &msg.ConnectCommand{ ConnId: id, HostPort: "example.com:443" }
+    tag := log.NewTag("conn", "conn", id)
+    go s.dial(conf, pool, c, cmd, tag, &accesslog.Entry{})
+}
+
+// connectAck waits for the next ConnectAck on the supply line.
+func connectAck(t *testing.T, s *SupplyLine, wait time.Duration) *msg.ConnectAckCommand {
+    select {
+    case buf := <-s.q_req:
+	cmd, _ := msg.ParseCommand(buf)
+	ack, ok := cmd.(*msg.ConnectAckCommand)
+	if !ok {
+	    t.Fatalf("got %s", cmd.Name())
+	}
+	return ack
+    case <-time.After(wait):
+	t.Fatalf("no ConnectAck in %v", wait)
+    }
+    return nil
+}
+
+func TestDialMaxDials(t *testing.T) {
+    proxy, accepted := silentProxy(t)
+    s, conf := testLine(t, proxy, "-max-dials", "2", "-connect-timeout", "10s")
+    pool := make(chan bool, conf.MaxDials)
+    for id := 0; id < 5; id++ {
+	startDial(t, s, conf, pool, id)
+    }
+    // the proxy closes the dials in progress, then the next ones start
+    for _, n := range []int{ 2, 2, 1 } {
+	held := []net.Conn{}
+	for len(held) < n {
+	    select {
+	    case conn := <-accepted:
+		held = append(held, conn)
+	    case <-time.After(time.Second * 2):
+		t.Fatalf("%d dials in progress, want %d", len(held), n)
+	    }
+	}
+	select {
+	case conn := <-accepted:
+	    conn.Close()
+	    t.Fatalf("more than %d dials at the same time", conf.MaxDials)
+	case <-time.After(time.Millisecond * 200):
+	}
+	for _, conn := range held {
+	    conn.Close()
+	}
+	for i := 0; i < n; i++ {
+	    if ack := connectAck(t, s, time.Second * 2); ack.Ok {
+		t.Errorf("conn %d: connected through a closed proxy", ack.ConnId)
+	    }
+	}
+    }
+}
+
+func TestDialConnectTimeout(t *testing.T) {
+    proxy, accepted := silentProxy(t)
+    s, conf := testLine(t, proxy, "-connect-timeout", "200ms")
+    start := time.Now()
+    startDial(t, s, conf, make(chan bool, conf.MaxDials), 7)
+    ack := connectAck(t, s, time.Second * 2)
+    if ack.ConnId != 7 || ack.Ok {
+	t.Fatalf("got %#v", ack)
+    }
+    if !strings.HasPrefix(ack.Reason, "dial:") {
+	t.Errorf("reason %q, want dial", ack.Reason)
+    }
+    if d := time.Since(start); d > time.Second {
+	t.Errorf("answered after %v", d)
+    }
+    // the slot is given back after the answer
+    c := s.cm.Get(7)
+    for i := 0; i < 100 && c.State() != msg.Cooldown; i++ {
+	time.Sleep(time.Millisecond * 10)
+    }
+    if st := c.State(); st != msg.Cooldown {
+	t.Errorf("state %s, want cooldown", st)
+    }
+    select {
+    case conn := <-accepted:
+	conn.Close()
+    default:
+    }
+}
+
+func TestDialPoolTimeout(t *testing.T) {
+    proxy, accepted := silentProxy(t)
+    s, conf := testLine(t, proxy, "-max-dials", "1", "-connect-timeout", "200ms")
+    // every slot is taken by a dial which does not end
+    pool := make(chan bool, conf.MaxDials)
+    pool <- true
+    start := time.Now()
+    startDial(t, s, conf, pool, 3)
+    ack := connectAck(t, s, time.Second * 2)
+    if ack.ConnId != 3 || ack.Ok || ack.Reason != "dial: timeout" {
+	t.Fatalf("got %#v", ack)
+    }
+    if d := time.Since(start); d > time.Second {
+	t.Errorf("answered after %v", d)
+    }
+    select {
+    case conn := <-accepted:
+	conn.Close()
+	t.Errorf("dialed without a slot")
+    default:
+    }
+    if len(pool) != 1 {
+	t.Errorf("%d slots taken", len(pool))
+    }
+    c := s.cm.Get(3)
+    for i := 0; i < 100 && c.State() != msg.Cooldown; i++ {
+	time.Sleep(time.Millisecond * 10)
+    }
+    if st := c.State(); st != msg.Cooldown {
+	t.Errorf("state %s, want cooldown", st)
+    }
+}
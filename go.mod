@@ -1,5 +1,9 @@
 module frontline
 
-go 1.15
+go 1.17
 
-require github.com/hshimamoto/go-session v0.0.0-20200912224910-d3d02d38e63d
+require (
+	github.com/hshimamoto/go-session v0.0.0-20200912224910-d3d02d38e63d
+	golang.org/x/crypto v0.10.0
+	golang.org/x/net v0.11.0
+)
@@ -0,0 +1,171 @@
+// HTTP frontline / lib/accesslog
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package accesslog
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "sync"
+    "time"
+)
+
+// Entry is one finished tunnel.
+type Entry struct {
+    Start time.Time `json:"start"`
+    Duration float64 `json:"duration"`
+    Client string `json:"client"`
+    Backline string `json:"backline"`
+    // authenticated proxy user
+    User string `json:"user,omitempty"`
+    HostPort string `json:"hostport"`
+    // resolved address of the destination
+    Addr string `json:"addr"`
+    // direct when backline dialed the destination itself
+    Route string `json:"route,omitempty"`
+    // ok or the failure reason
+    Result string `json:"result"`
+    BytesUp int64 `json:"bytes_up"`
+    BytesDown int64 `json:"bytes_down"`
+}
+
+// Config is the access log configuration.
+type Config struct {
+    // json or clf
+    Format string `json:"format"`
+    // stdout, stderr or a file path, empty disables the log
+    Output string `json:"output"`
+}
+
+func (c *Config)Validate() error {
+    switch c.Format {
+    case "json", "clf":
+    default:
+	return fmt.Errorf("unknown access log format %s", c.Format)
+    }
+    return nil
+}
+
+var (
+    lock sync.Mutex
+    clf = false
+    out io.Writer = nil
+)
+
+func closeOutput(w io.Writer) {
+    if f, ok := w.(*os.File); ok && f != os.Stdout && f != os.Stderr {
+	f.Close()
+    }
+}
+
+// Output is an opened access log, Use starts writing to it.
+type Output struct {
+    w io.Writer
+    clf bool
+}
+
+// Open checks c and opens the file it names.
+func Open(c *Config) (*Output, error) {
+    if err := c.Validate(); err != nil {
+	return nil, err
+    }
+    o := &Output{ clf: c.Format == "clf" }
+    switch c.Output {
+    case "":
+    case "stdout":
+	o.w = os.Stdout
+    case "stderr":
+	o.w = os.Stderr
+    default:
+	f, err := os.OpenFile(c.Output, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+	if err != nil {
+	    return nil, err
+	}
+	o.w = f
+    }
+    return o, nil
+}
+
+// Use writes the next lines to o and closes the previous output.
+func (o *Output)Use() {
+    lock.Lock()
+    old := out
+    out = o.w
+    clf = o.clf
+    lock.Unlock()
+    closeOutput(old)
+}
+
+// Close closes o when it is not going to be used.
+func (o *Output)Close() {
+    closeOutput(o.w)
+}
+
+// Status maps the result to an HTTP status for the CLF line.
+func Status(result string) int {
+    switch result {
+    case "ok":
+	return 200
+    case "bad_request":
+	return 400
+    case "denied":
+	return 403
+    case "auth":
+	return 407
+    case "timeout":
+	return 408
+    case "quota":
+	return 429
+    case "no_link", "no_slot", "shutdown":
+	return 503
+    }
+    return 502
+}
+
+func dash(s string) string {
+    if s == "" {
+	return "-"
+    }
+    return s
+}
+
+// CLF formats e like the common log format with the backline name in the
+// ident field, followed by bytes up, destination address, result and
+// duration.
+//   client backline user [time] "CONNECT hostport" status down up addr result duration
+func (e *Entry)CLF() string {
+    return fmt.Sprintf("%s %s %s [%s] \"CONNECT %s\" %d %d %d %s %s %.3f",
+	dash(e.Client), dash(e.Backline), dash(e.User), e.Start.Format("02/Jan/2006:15:04:05 -0700"),
+	dash(e.HostPort), Status(e.Result), e.BytesDown, e.BytesUp,
+	dash(e.Addr), dash(e.Result), e.Duration)
+}
+
+// Finish sets Duration from Start to end.
+func (e *Entry)Finish(end time.Time) {
+    e.Duration = end.Sub(e.Start).Round(time.Millisecond).Seconds()
+}
+
+// Write logs e. Duration is filled if Finish was not called.
+func Write(e *Entry) {
+    if e.Duration == 0 {
+	e.Finish(time.Now())
+    }
+    lock.Lock()
+    defer lock.Unlock()
+    if out == nil {
+	return
+    }
+    var line string
+    if clf {
+	line = e.CLF()
+    } else {
+	b, err := json.Marshal(e)
+	if err != nil {
+	    return
+	}
+	line = string(b)
+    }
+    io.WriteString(out, line + "\n")
+}
@@ -0,0 +1,210 @@
+// HTTP frontline / lib/admin
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package admin
+
+import (
+    "crypto/subtle"
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+
+    "frontline/lib/log"
+    "frontline/lib/msg"
+)
+
+// Link is a supply line shown by the admin API.
+type Link struct {
+    Name string
+    Peer func() string
+    Status func() string
+    CM *msg.ConnectionManager
+}
+
+type linkInfo struct {
+    Name string `json:"name"`
+    Peer string `json:"peer"`
+    Status string `json:"status"`
+    Connections []msg.ConnectionInfo `json:"connections"`
+}
+
+var (
+    lock sync.Mutex
+    links = map[string]*Link{}
+    reload func() ([]string, error)
+    token string
+)
+
+// SetToken sets the bearer token required by the POST requests, empty for
+// none.
+func SetToken(t string) {
+    lock.Lock()
+    token = t
+    lock.Unlock()
+}
+
+// SetReload sets the function called by POST /reload.
+func SetReload(f func() ([]string, error)) {
+    lock.Lock()
+    reload = f
+    lock.Unlock()
+}
+
+func Register(l *Link) {
+    lock.Lock()
+    links[l.Name] = l
+    lock.Unlock()
+}
+
+func Unregister(l *Link) {
+    lock.Lock()
+    if links[l.Name] == l {
+	delete(links, l.Name)
+    }
+    lock.Unlock()
+}
+
+func lookup(name string) *Link {
+    lock.Lock()
+    defer lock.Unlock()
+    return links[name]
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "  ")
+    enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, format string, v ...interface{}) {
+    writeJSON(w, code, map[string]string{ "error": fmt.Sprintf(format, v...) })
+}
+
+// GET /links
+func handleLinks(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+	writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	return
+    }
+    lock.Lock()
+    list := []linkInfo{}
+    for _, l := range links {
+	list = append(list, linkInfo{
+	    Name: l.Name,
+	    Peer: l.Peer(),
+	    Status: l.Status(),
+	    Connections: l.CM.Active(),
+	})
+    }
+    lock.Unlock()
+    writeJSON(w, http.StatusOK, list)
+}
+
+// checkPost refuses requests a browser could be tricked into sending, a
+// form or a cross-origin fetch, and checks the token.
+func checkPost(w http.ResponseWriter, r *http.Request) bool {
+    if r.Method != http.MethodPost {
+	writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	return false
+    }
+    if r.Header.Get("Origin") != "" {
+	writeError(w, http.StatusForbidden, "cross-origin request refused")
+	return false
+    }
+    if ct := r.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "application/json") {
+	writeError(w, http.StatusUnsupportedMediaType, "content type %s not allowed", ct)
+	return false
+    }
+    lock.Lock()
+    t := token
+    lock.Unlock()
+    if t != "" {
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(got), []byte(t)) != 1 {
+	    writeError(w, http.StatusUnauthorized, "bad token")
+	    return false
+	}
+    }
+    return true
+}
+
+// POST /cancel?link=name&id=N
+func handleCancel(w http.ResponseWriter, r *http.Request) {
+    if !checkPost(w, r) {
+	return
+    }
+    q := r.URL.Query()
+    name := q.Get("link")
+    l := lookup(name)
+    if l == nil {
+	writeError(w, http.StatusNotFound, "no link %s", name)
+	return
+    }
+    id, err := strconv.Atoi(q.Get("id"))
+    if err != nil {
+	writeError(w, http.StatusBadRequest, "bad id %s", q.Get("id"))
+	return
+    }
+    c := l.CM.Get(id)
+    if c == nil || c.State() == msg.Idle {
+	writeError(w, http.StatusNotFound, "no connection %d", id)
+	return
+    }
+    info := c.Info()
+    if !c.Cancel() {
+	writeError(w, http.StatusConflict, "connection %d is %s", id, info.State)
+	return
+    }
+    log.NewTag("admin", "link", name, "conn", id).Printf("cancel connection")
+    writeJSON(w, http.StatusAccepted, c.Info())
+}
+
+// POST /reload
+func handleReload(w http.ResponseWriter, r *http.Request) {
+    if !checkPost(w, r) {
+	return
+    }
+    lock.Lock()
+    f := reload
+    lock.Unlock()
+    if f == nil {
+	writeError(w, http.StatusNotImplemented, "reload not supported")
+	return
+    }
+    log.NewTag("admin").Printf("reload configuration")
+    msgs, err := f()
+    if err != nil {
+	writeError(w, http.StatusBadRequest, "%v", err)
+	return
+    }
+    writeJSON(w, http.StatusOK, map[string][]string{ "changes": msgs })
+}
+
+// Addr binds to localhost unless a host is given.
+func Addr(addr string) string {
+    host, port, err := net.SplitHostPort(addr)
+    if err != nil {
+	return addr
+    }
+    if host == "" {
+	host = "127.0.0.1"
+    }
+    return net.JoinHostPort(host, port)
+}
+
+// Serve runs the admin API on addr.
+func Serve(addr string) error {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/links", handleLinks)
+    mux.HandleFunc("/cancel", handleCancel)
+    mux.HandleFunc("/reload", handleReload)
+    addr = Addr(addr)
+    log.NewTag("admin").Printf("listen %s", addr)
+    return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,154 @@
+// HTTP frontline / lib/auth
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package auth
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base64"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+
+    "golang.org/x/crypto/pbkdf2"
+)
+
+// Iterations is used for new hashes.
+var Iterations = 100000
+
+const scheme = "pbkdf2-sha256"
+
+// Hash returns "pbkdf2-sha256$iterations$salt$hash" for the file.
+func Hash(password string) (string, error) {
+    salt := make([]byte, 16)
+    if _, err := rand.Read(salt); err != nil {
+	return "", err
+    }
+    key := pbkdf2.Key([]byte(password), salt, Iterations, sha256.Size, sha256.New)
+    enc := base64.RawStdEncoding
+    return fmt.Sprintf("%s$%d$%s$%s", scheme, Iterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+type hash struct {
+    iter int
+    salt []byte
+    key []byte
+}
+
+func parseHash(s string) (*hash, error) {
+    w := strings.Split(s, "$")
+    if len(w) != 4 || w[0] != scheme {
+	return nil, fmt.Errorf("unknown hash, want %s$iterations$salt$hash", scheme)
+    }
+    iter, err := strconv.Atoi(w[1])
+    if err != nil || iter < 1 {
+	return nil, fmt.Errorf("bad iterations %s", w[1])
+    }
+    enc := base64.RawStdEncoding
+    salt, err := enc.DecodeString(w[2])
+    if err != nil {
+	return nil, fmt.Errorf("bad salt: %v", err)
+    }
+    key, err := enc.DecodeString(w[3])
+    if err != nil || len(key) != sha256.Size {
+	return nil, fmt.Errorf("bad hash")
+    }
+    return &hash{ iter: iter, salt: salt, key: key }, nil
+}
+
+func (h *hash)match(password string) bool {
+    key := pbkdf2.Key([]byte(password), h.salt, h.iter, sha256.Size, sha256.New)
+    return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+// Credentials are users read from a file of "user:hash" lines.
+type Credentials struct {
+    users map[string]*hash
+    // checked passwords, a browser connects many times
+    mu sync.Mutex
+    verified map[string][sha256.Size]byte
+}
+
+func Load(path string) (*Credentials, error) {
+    f, err := os.Open(path)
+    if err != nil {
+	return nil, err
+    }
+    defer f.Close()
+    c := &Credentials{
+	users: map[string]*hash{},
+	verified: map[string][sha256.Size]byte{},
+    }
+    s := bufio.NewScanner(f)
+    n := 0
+    for s.Scan() {
+	n++
+	line := strings.TrimSpace(s.Text())
+	if line == "" || line[0] == '#' {
+	    continue
+	}
+	i := strings.Index(line, ":")
+	if i <= 0 {
+	    return nil, fmt.Errorf("%s:%d: want user:hash", path, n)
+	}
+	h, err := parseHash(line[i + 1:])
+	if err != nil {
+	    return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+	}
+	c.users[line[:i]] = h
+    }
+    if err := s.Err(); err != nil {
+	return nil, err
+    }
+    return c, nil
+}
+
+// Has reports whether user is in the file.
+func (c *Credentials)Has(user string) bool {
+    _, ok := c.users[user]
+    return ok
+}
+
+func (c *Credentials)Check(user, password string) bool {
+    h, ok := c.users[user]
+    if !ok {
+	return false
+    }
+    sum := sha256.Sum256(append(append([]byte{}, h.salt...), password...))
+    c.mu.Lock()
+    v, ok := c.verified[user]
+    c.mu.Unlock()
+    if ok && subtle.ConstantTimeCompare(v[:], sum[:]) == 1 {
+	return true
+    }
+    if !h.match(password) {
+	return false
+    }
+    c.mu.Lock()
+    c.verified[user] = sum
+    c.mu.Unlock()
+    return true
+}
+
+// ParseBasic decodes a "Basic base64(user:password)" header value.
+func ParseBasic(v string) (string, string, bool) {
+    const prefix = "basic "
+    if len(v) < len(prefix) || strings.ToLower(v[:len(prefix)]) != prefix {
+	return "", "", false
+    }
+    b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v[len(prefix):]))
+    if err != nil {
+	return "", "", false
+    }
+    i := bytes.IndexByte(b, ':')
+    if i < 0 {
+	return "", "", false
+    }
+    return string(b[:i]), string(b[i + 1:]), true
+}
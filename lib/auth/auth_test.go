@@ -0,0 +1,100 @@
+// HTTP frontline / lib/auth
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package auth
+
+import (
+    "encoding/base64"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestParseBasic(t *testing.T) {
+    basic := func(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+    }
+    tests := []struct {
+	v string
+	user, pass string
+	ok bool
+    }{
+	{ "Basic " + basic("alice:secret"), "alice", "secret", true },
+	{ "basic " + basic("alice:secret"), "alice", "secret", true },
+	{ "BASIC  " + basic("alice:secret") + " ", "alice", "secret", true },
+	// the password may have a colon, the user may not
+	{ "Basic " + basic("alice:a:b"), "alice", "a:b", true },
+	{ "Basic " + basic("alice:"), "alice", "", true },
+	{ "Basic " + basic("alice"), "", "", false },
+	{ "Basic !!!", "", "", false },
+	{ "Bearer " + basic("alice:secret"), "", "", false },
+	{ "Basic", "", "", false },
+	{ "", "", "", false },
+    }
+    for _, tt := range tests {
+	user, pass, ok := ParseBasic(tt.v)
+	if user != tt.user || pass != tt.pass || ok != tt.ok {
+	    t.Errorf("%q: got %q, %q, %v", tt.v, user, pass, ok)
+	}
+    }
+}
+
+// load writes lines to a file and loads it.
+func load(t *testing.T, lines ...string) (*Credentials, error) {
+    path := filepath.Join(t.TempDir(), "auth")
+    if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+	t.Fatal(err)
+    }
+    return Load(path)
+}
+
+func TestHashCheck(t *testing.T) {
+    defer func(n int) { Iterations = n }(Iterations)
+    Iterations = 1000
+    h, err := Hash("secret")
+    if err != nil {
+	t.Fatal(err)
+    }
+    if !strings.HasPrefix(h, "pbkdf2-sha256$1000$") {
+	t.Errorf("hash %s", h)
+    }
+    c, err := load(t, "# users", "", "alice:" + h)
+    if err != nil {
+	t.Fatalf("Load: %v", err)
+    }
+    if !c.Has("alice") || c.Has("bob") {
+	t.Errorf("users %v", c.users)
+    }
+    // the second time is answered from the cache
+    for i := 0; i < 2; i++ {
+	if !c.Check("alice", "secret") {
+	    t.Errorf("%d: right password refused", i)
+	}
+	if c.Check("alice", "secret2") || c.Check("alice", "") {
+	    t.Errorf("%d: wrong password accepted", i)
+	}
+    }
+    if c.Check("bob", "secret") {
+	t.Errorf("unknown user accepted")
+    }
+}
+
+func TestLoadMalformed(t *testing.T) {
+    key := base64.RawStdEncoding.EncodeToString(make([]byte, 32))
+    tests := []string{
+	"alice",
+	":pbkdf2-sha256$1000$c2FsdA$" + key,
+	"alice:sha1$1000$c2FsdA$" + key,
+	"alice:pbkdf2-sha256$1000$c2FsdA",
+	"alice:pbkdf2-sha256$0$c2FsdA$" + key,
+	"alice:pbkdf2-sha256$many$c2FsdA$" + key,
+	"alice:pbkdf2-sha256$1000$!!$" + key,
+	"alice:pbkdf2-sha256$1000$c2FsdA$c2hvcnQ",
+    }
+    for _, line := range tests {
+	if _, err := load(t, line); err == nil {
+	    t.Errorf("%q: loaded", line)
+	}
+    }
+}
@@ -0,0 +1,810 @@
+// HTTP frontline / lib/config
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package config
+
+import (
+    "bytes"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "net/url"
+    "path"
+    "reflect"
+    "strings"
+    "time"
+
+    "frontline/lib/accesslog"
+    "frontline/lib/admin"
+    "frontline/lib/auth"
+    "frontline/lib/connection"
+    "frontline/lib/egress"
+    "frontline/lib/log"
+    "frontline/lib/match"
+    "frontline/lib/pac"
+    "frontline/lib/quota"
+    "frontline/lib/ratelimit"
+    "frontline/lib/supplyline"
+)
+
+// Duration is a time.Duration written as "30s" in the file.
+type Duration struct {
+    time.Duration
+}
+
+func (d *Duration)UnmarshalJSON(b []byte) error {
+    var s string
+    if err := json.Unmarshal(b, &s); err != nil {
+	return fmt.Errorf("bad duration %s, want a string like \"30s\"", string(b))
+    }
+    v, err := time.ParseDuration(s)
+    if err != nil {
+	return err
+    }
+    d.Duration = v
+    return nil
+}
+
+func (d Duration)MarshalJSON() ([]byte, error) {
+    return json.Marshal(d.String())
+}
+
+type DestRate struct {
+    Pattern string `json:"pattern"`
+    Rate string `json:"rate"`
+}
+
+type Priority struct {
+    Pattern string `json:"pattern"`
+    Priority int `json:"priority"`
+    pattern *match.Pattern
+}
+
+// Route decides how frontline reaches a destination: direct, deny or
+// proxy through Proxy.
+type Route struct {
+    Pattern string `json:"pattern"`
+    Action string `json:"action"`
+    Proxy string `json:"proxy,omitempty"`
+    pattern *match.Pattern
+    proxy *url.URL
+}
+
+// ProxyURL returns the upstream proxy, nil unless Action is proxy.
+func (r *Route)ProxyURL() *url.URL {
+    return r.proxy
+}
+
+var directRoute = &Route{ Pattern: "*", Action: "direct" }
+
+// Backline names the backlines connecting from CIDRs, frontline trusts
+// the address of the supply line and not the name backline sends.
+type Backline struct {
+    Name string `json:"name"`
+    CIDRs []string `json:"cidrs"`
+    nets []*net.IPNet
+}
+
+// Source selects the local address or interface of egress dials for a
+// backline identity (glob, see BacklineIdentity) and destination pattern,
+// empty matches all.
+type Source struct {
+    Backline string `json:"backline,omitempty"`
+    Pattern string `json:"pattern,omitempty"`
+    Addrs []string `json:"addrs"`
+    Device string `json:"device,omitempty"`
+    RoundRobin bool `json:"round_robin,omitempty"`
+    pattern *match.Pattern
+    source *egress.Source
+}
+
+func (s *Source)match(backline, hostport string) bool {
+    if s.Backline != "" {
+	if ok, _ := path.Match(s.Backline, backline); !ok {
+	    return false
+	}
+    }
+    return s.pattern == nil || s.pattern.Match(hostport)
+}
+
+type Config struct {
+    // backline only
+    Frontline string `json:"frontline"`
+    Listen string `json:"listen"`
+    Metrics string `json:"metrics"`
+    Admin string `json:"admin"`
+    // bearer token for POST on the admin API
+    AdminToken string `json:"admin_token"`
+    // CIDR lists checked on accept of listen
+    Allow []string `json:"allow"`
+    Deny []string `json:"deny"`
+    // backline only, credentials file for the proxy
+    Auth string `json:"auth"`
+    // backline only, CONNECT request limits
+    MaxHeaderSize int `json:"max_header_size"`
+    HeaderTimeout Duration `json:"header_timeout"`
+    // backline only, proxy auto-config for browsers
+    PAC pac.Config `json:"pac"`
+    // backline only, destinations dialed directly or rejected
+    Split []*SplitRule `json:"split"`
+    // dialing destinations, on backline for split direct
+    ConnectTimeout Duration `json:"connect_timeout"`
+    AttemptTimeout Duration `json:"attempt_timeout"`
+    MaxDials int `json:"max_dials"`
+    Routes []*Route `json:"routes"`
+    // egress source, global and by backline and destination
+    Source []string `json:"source"`
+    Device string `json:"device"`
+    RoundRobin bool `json:"round_robin"`
+    Sources []*Source `json:"sources"`
+    DNS egress.ResolverConfig `json:"dns"`
+    // frontline only, identities of backlines for sources and quotas
+    Backlines []*Backline `json:"backlines"`
+    // frontline only, limits by backline and user
+    Quotas quota.Config `json:"quotas"`
+    // rate limits
+    Rate string `json:"rate"`
+    ConnRate string `json:"conn_rate"`
+    DestRates []DestRate `json:"dest_rates"`
+    // scheduling
+    Priorities []*Priority `json:"priorities"`
+    // supply line
+    Keepalive Duration `json:"keepalive"`
+    KeepaliveLost int `json:"keepalive_lost"`
+    DeadTimeout Duration `json:"dead_timeout"`
+    TCPKeepalive Duration `json:"tcp_keepalive"`
+    DrainTimeout Duration `json:"drain_timeout"`
+    // logging
+    Log log.Config `json:"log"`
+    AccessLog accesslog.Config `json:"access_log"`
+
+    cmd string
+    path string
+    check bool
+    hashPassword bool
+    credentials *auth.Credentials
+    acl *connection.ACL
+    source *egress.Source
+    resolver *egress.Resolver
+}
+
+func Default(cmd string) *Config {
+    return &Config{
+	Listen: ":8443",
+	MaxHeaderSize: 8192,
+	HeaderTimeout: Duration{ time.Second * 10 },
+	ConnectTimeout: Duration{ time.Second * 10 },
+	AttemptTimeout: Duration{ time.Second * 3 },
+	MaxDials: 64,
+	DNS: egress.ResolverConfig{ Timeout: "5s", CacheTTL: "1m", NegativeTTL: "10s" },
+	Rate: "0",
+	ConnRate: "0",
+	Keepalive: Duration{ time.Minute },
+	KeepaliveLost: 2,
+	DeadTimeout: Duration{ time.Minute * 2 },
+	TCPKeepalive: Duration{ time.Minute },
+	DrainTimeout: Duration{ time.Second * 30 },
+	Log: log.Config{ Level: "info", Format: "text", Output: "stderr" },
+	AccessLog: accesslog.Config{ Format: "json" },
+	cmd: cmd,
+    }
+}
+
+type destRateFlag struct {
+    c *Config
+    set bool
+}
+
+func (f *destRateFlag)String() string {
+    if f.c == nil {
+	return ""
+    }
+    l := []string{}
+    for _, r := range f.c.DestRates {
+	l = append(l, r.Pattern + "=" + r.Rate)
+    }
+    return strings.Join(l, ",")
+}
+
+func (f *destRateFlag)Set(s string) error {
+    i := strings.LastIndex(s, "=")
+    if i < 0 {
+	return fmt.Errorf("want pattern=rate")
+    }
+    // flags replace the list in the file
+    if !f.set {
+	f.c.DestRates = nil
+	f.set = true
+    }
+    f.c.DestRates = append(f.c.DestRates, DestRate{ Pattern: s[:i], Rate: s[i + 1:] })
+    return nil
+}
+
+// listFlag appends comma separated values, flags replace the list in the
+// file.
+type listFlag struct {
+    list *[]string
+    set bool
+}
+
+func (f *listFlag)String() string {
+    if f.list == nil {
+	return ""
+    }
+    return strings.Join(*f.list, ",")
+}
+
+func (f *listFlag)Set(s string) error {
+    if !f.set {
+	*f.list = nil
+	f.set = true
+    }
+    *f.list = append(*f.list, strings.Split(s, ",")...)
+    return nil
+}
+
+// routeFlag takes pattern=direct, pattern=deny or pattern=proxy-URL.
+type routeFlag struct {
+    c *Config
+    set bool
+}
+
+func (f *routeFlag)String() string {
+    if f.c == nil {
+	return ""
+    }
+    l := []string{}
+    for _, r := range f.c.Routes {
+	v := r.Action
+	if r.Action == "proxy" {
+	    v = r.Proxy
+	}
+	l = append(l, r.Pattern + "=" + v)
+    }
+    return strings.Join(l, ",")
+}
+
+func (f *routeFlag)Set(s string) error {
+    i := strings.Index(s, "=")
+    if i < 0 {
+	return fmt.Errorf("want pattern=direct|deny|proxy-URL")
+    }
+    if !f.set {
+	f.c.Routes = nil
+	f.set = true
+    }
+    r := &Route{ Pattern: s[:i], Action: s[i + 1:] }
+    if r.Action != "direct" && r.Action != "deny" {
+	r.Action, r.Proxy = "proxy", s[i + 1:]
+    }
+    f.c.Routes = append(f.c.Routes, r)
+    return nil
+}
+
+func (c *Config)flags() *flag.FlagSet {
+    fs := flag.NewFlagSet(c.cmd, flag.ContinueOnError)
+    fs.StringVar(&c.path, "config", c.path, "configuration file (JSON)")
+    fs.BoolVar(&c.check, "check-config", false, "validate configuration and exit")
+    fs.StringVar(&c.Metrics, "metrics", c.Metrics, "export metrics on http://addr/metrics")
+    fs.StringVar(&c.Admin, "admin", c.Admin, "admin API address (localhost unless host is given)")
+    if c.cmd == "frontline" {
+	fs.DurationVar(&c.ConnectTimeout.Duration, "connect-timeout", c.ConnectTimeout.Duration, "timeout to connect to a destination")
+	fs.DurationVar(&c.AttemptTimeout.Duration, "attempt-timeout", c.AttemptTimeout.Duration, "timeout to connect to one address of a destination")
+	fs.IntVar(&c.MaxDials, "max-dials", c.MaxDials, "destinations dialed at the same time")
+	fs.Var(&routeFlag{ c: c }, "route", "egress route, pattern=direct|deny|proxy-URL (repeatable, first match wins)")
+	fs.Var(&listFlag{ list: &c.Source }, "source", "local addresses for egress dials (repeatable)")
+	fs.StringVar(&c.Device, "device", c.Device, "network interface for egress dials (linux)")
+	fs.BoolVar(&c.RoundRobin, "round-robin", c.RoundRobin, "use the -source addresses in turn")
+	fs.Var(&listFlag{ list: &c.DNS.Servers }, "dns", "DNS servers, host[:port] (repeatable)")
+	fs.BoolVar(&c.DNS.TCP, "dns-tcp", c.DNS.TCP, "query DNS servers over TCP")
+	fs.StringVar(&c.DNS.Prefer, "dns-prefer", c.DNS.Prefer, "address family to dial first: ipv4 or ipv6")
+    }
+    fs.Var(&listFlag{ list: &c.Allow }, "allow", "CIDRs allowed to connect to listen (repeatable)")
+    fs.Var(&listFlag{ list: &c.Deny }, "deny", "CIDRs denied to connect to listen (repeatable)")
+    if c.cmd == "backline" {
+	fs.StringVar(&c.Auth, "auth", c.Auth, "credentials file, user:hash lines")
+	fs.BoolVar(&c.hashPassword, "hash-password", false, "read a password from stdin, print the hash for -auth and exit")
+	fs.IntVar(&c.MaxHeaderSize, "max-header-size", c.MaxHeaderSize, "size limit of the CONNECT request header")
+	fs.DurationVar(&c.HeaderTimeout.Duration, "header-timeout", c.HeaderTimeout.Duration, "time to receive the CONNECT request header")
+	fs.Var(&splitFlag{ c: c }, "split", "split route, domain|cidr|port=direct|tunnel|reject (repeatable, first match wins)")
+	fs.StringVar(&c.PAC.Listen, "pac", c.PAC.Listen, "serve http://addr/proxy.pac")
+    }
+    fs.StringVar(&c.Rate, "rate", c.Rate, "limit of the whole supply line in bytes/sec (k, m, g suffix)")
+    fs.StringVar(&c.ConnRate, "conn-rate", c.ConnRate, "limit of each connection in bytes/sec")
+    fs.Var(&destRateFlag{ c: c }, "dest-rate", "limit for destinations, pattern=rate (repeatable)")
+    fs.DurationVar(&c.Keepalive.Duration, "keepalive", c.Keepalive.Duration, "keepalive interval of the supply line")
+    fs.IntVar(&c.KeepaliveLost, "keepalive-lost", c.KeepaliveLost, "keepalives lost in a row before the link is dead")
+    fs.DurationVar(&c.DeadTimeout.Duration, "dead-timeout", c.DeadTimeout.Duration, "time without receiving anything before the link is dead")
+    fs.DurationVar(&c.TCPKeepalive.Duration, "tcp-keepalive", c.TCPKeepalive.Duration, "TCP keepalive period")
+    fs.DurationVar(&c.DrainTimeout.Duration, "drain-timeout", c.DrainTimeout.Duration, "time to wait for connections on shutdown")
+    fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "log level: debug, info, warn or error")
+    fs.StringVar(&c.Log.Format, "log-format", c.Log.Format, "log format: text or json")
+    fs.StringVar(&c.Log.Output, "log-output", c.Log.Output, "log output: stderr, syslog or a file path")
+    fs.StringVar(&c.AccessLog.Output, "access-log", c.AccessLog.Output, "access log output: stdout, stderr or a file path")
+    fs.StringVar(&c.AccessLog.Format, "access-log-format", c.AccessLog.Format, "access log format: json or clf")
+    return fs
+}
+
+// position converts an offset in the file to line:column.
+func position(buf []byte, offset int64) string {
+    if offset > int64(len(buf)) {
+	offset = int64(len(buf))
+    }
+    line := 1 + bytes.Count(buf[:offset], []byte{'\n'})
+    col := offset - int64(bytes.LastIndexByte(buf[:offset], '\n'))
+    return fmt.Sprintf("%d:%d", line, col)
+}
+
+func (c *Config)load(path string) error {
+    buf, err := ioutil.ReadFile(path)
+    if err != nil {
+	return err
+    }
+    dec := json.NewDecoder(bytes.NewReader(buf))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(c); err != nil {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+	    return fmt.Errorf("%s:%s: %v", path, position(buf, e.Offset), err)
+	case *json.UnmarshalTypeError:
+	    return fmt.Errorf("%s:%s: %s: want %v", path, position(buf, e.Offset), e.Field, e.Type)
+	}
+	return fmt.Errorf("%s: %v", path, err)
+    }
+    return nil
+}
+
+// Parse reads the command line, loads the configuration file given by
+// -config and applies the command line again to override the file.
+func Parse(cmd string, args []string) (*Config, error) {
+    c := Default(cmd)
+    fs := c.flags()
+    if err := fs.Parse(args); err != nil {
+	return nil, err
+    }
+    if c.path != "" {
+	path := c.path
+	c = Default(cmd)
+	c.path = path
+	if err := c.load(path); err != nil {
+	    return nil, err
+	}
+	fs = c.flags()
+	if err := fs.Parse(args); err != nil {
+	    return nil, err
+	}
+    }
+    if c.hashPassword {
+	return c, nil
+    }
+    switch cmd {
+    case "backline":
+	// backline [options] <frontline> [listen]
+	if fs.NArg() > 0 {
+	    c.Frontline = fs.Arg(0)
+	}
+	if fs.NArg() > 1 {
+	    c.Listen = fs.Arg(1)
+	}
+    case "frontline":
+	// frontline [options] [listen]
+	if fs.NArg() > 0 {
+	    c.Listen = fs.Arg(0)
+	}
+    }
+    if err := c.Validate(); err != nil {
+	if c.path != "" {
+	    return nil, fmt.Errorf("%s: %v", c.path, err)
+	}
+	return nil, err
+    }
+    return c, nil
+}
+
+func checkAddr(name, addr string) error {
+    if addr == "" {
+	return nil
+    }
+    if strings.HasPrefix(addr, "unix:") {
+	return nil
+    }
+    if _, _, err := net.SplitHostPort(addr); err != nil {
+	return fmt.Errorf("%s: %v", name, err)
+    }
+    return nil
+}
+
+func (c *Config)Validate() error {
+    if c.cmd == "backline" && c.Frontline == "" {
+	return fmt.Errorf("frontline: no address")
+    }
+    if c.cmd != "backline" && c.Frontline != "" {
+	return fmt.Errorf("frontline: only for backline")
+    }
+    if c.Auth != "" {
+	if c.cmd != "backline" {
+	    return fmt.Errorf("auth: only for backline")
+	}
+	cred, err := auth.Load(c.Auth)
+	if err != nil {
+	    return fmt.Errorf("auth: %v", err)
+	}
+	c.credentials = cred
+    }
+    if c.PAC.Listen != "" && c.cmd != "backline" {
+	return fmt.Errorf("pac: only for backline")
+    }
+    if err := c.PAC.Validate(); err != nil {
+	return fmt.Errorf("pac: %v", err)
+    }
+    for i, r := range c.Split {
+	if c.cmd != "backline" {
+	    return fmt.Errorf("split: only for backline")
+	}
+	if err := r.validate(); err != nil {
+	    return fmt.Errorf("split[%d]: %v", i, err)
+	}
+    }
+    if c.MaxHeaderSize < 256 {
+	return fmt.Errorf("max_header_size: %d too small", c.MaxHeaderSize)
+    }
+    if c.HeaderTimeout.Duration <= 0 {
+	return fmt.Errorf("header_timeout: %v must be positive", c.HeaderTimeout)
+    }
+    if c.ConnectTimeout.Duration <= 0 {
+	return fmt.Errorf("connect_timeout: %v must be positive", c.ConnectTimeout)
+    }
+    if c.AttemptTimeout.Duration <= 0 {
+	return fmt.Errorf("attempt_timeout: %v must be positive", c.AttemptTimeout)
+    }
+    if c.MaxDials < 1 {
+	return fmt.Errorf("max_dials: %d must be positive", c.MaxDials)
+    }
+    for i, r := range c.Routes {
+	if c.cmd != "frontline" {
+	    return fmt.Errorf("routes: only for frontline")
+	}
+	pat, err := match.Parse(r.Pattern)
+	if err != nil {
+	    return fmt.Errorf("routes[%d]: %v", i, err)
+	}
+	r.pattern = pat
+	switch r.Action {
+	case "direct", "deny":
+	    if r.Proxy != "" {
+		return fmt.Errorf("routes[%d]: proxy only for action proxy", i)
+	    }
+	case "proxy":
+	    u, err := egress.ParseProxy(r.Proxy)
+	    if err != nil {
+		return fmt.Errorf("routes[%d]: %v", i, err)
+	    }
+	    r.proxy = u
+	default:
+	    return fmt.Errorf("routes[%d]: unknown action %s", i, r.Action)
+	}
+    }
+    if len(c.Source) > 0 || c.Device != "" || len(c.Sources) > 0 {
+	if c.cmd != "frontline" {
+	    return fmt.Errorf("source: only for frontline")
+	}
+    }
+    if len(c.Source) > 0 || c.Device != "" {
+	src, err := egress.NewSource(c.Source, c.Device, c.RoundRobin)
+	if err != nil {
+	    return fmt.Errorf("source: %v", err)
+	}
+	c.source = src
+    }
+    for i, s := range c.Sources {
+	if _, err := path.Match(s.Backline, ""); err != nil {
+	    return fmt.Errorf("sources[%d]: bad backline %s", i, s.Backline)
+	}
+	if s.Pattern != "" {
+	    pat, err := match.Parse(s.Pattern)
+	    if err != nil {
+		return fmt.Errorf("sources[%d]: %v", i, err)
+	    }
+	    s.pattern = pat
+	}
+	if len(s.Addrs) == 0 && s.Device == "" {
+	    return fmt.Errorf("sources[%d]: no addrs or device", i)
+	}
+	src, err := egress.NewSource(s.Addrs, s.Device, s.RoundRobin)
+	if err != nil {
+	    return fmt.Errorf("sources[%d]: %v", i, err)
+	}
+	s.source = src
+    }
+    for i, b := range c.Backlines {
+	if c.cmd != "frontline" {
+	    return fmt.Errorf("backlines: only for frontline")
+	}
+	if b.Name == "" {
+	    return fmt.Errorf("backlines[%d]: no name", i)
+	}
+	b.nets = nil
+	for _, cidr := range b.CIDRs {
+	    n, err := connection.ParseCIDR(cidr)
+	    if err != nil {
+		return fmt.Errorf("backlines[%d]: %v", i, err)
+	    }
+	    b.nets = append(b.nets, n)
+	}
+    }
+    if len(c.Quotas.Rules) > 0 || c.Quotas.State != "" {
+	if c.cmd != "frontline" {
+	    return fmt.Errorf("quotas: only for frontline")
+	}
+    }
+    if err := c.Quotas.Validate(); err != nil {
+	return fmt.Errorf("quotas: %v", err)
+    }
+    if err := c.DNS.Validate(); err != nil {
+	return fmt.Errorf("dns: %v", err)
+    }
+    if c.Listen == "" {
+	return fmt.Errorf("listen: no address")
+    }
+    for _, a := range []struct{ name, addr string }{
+	{ "listen", c.Listen }, { "metrics", c.Metrics }, { "admin", c.Admin },
+    } {
+	if err := checkAddr(a.name, a.addr); err != nil {
+	    return err
+	}
+    }
+    acl, err := connection.NewACL(c.Allow, c.Deny)
+    if err != nil {
+	return err
+    }
+    c.acl = acl
+    if _, err := ratelimit.ParseRate(c.Rate); err != nil {
+	return fmt.Errorf("rate: %v", err)
+    }
+    if _, err := ratelimit.ParseRate(c.ConnRate); err != nil {
+	return fmt.Errorf("conn_rate: %v", err)
+    }
+    for i, r := range c.DestRates {
+	if _, err := match.Parse(r.Pattern); err != nil {
+	    return fmt.Errorf("dest_rates[%d]: %v", i, err)
+	}
+	if _, err := ratelimit.ParseRate(r.Rate); err != nil {
+	    return fmt.Errorf("dest_rates[%d]: %v", i, err)
+	}
+    }
+    for i, p := range c.Priorities {
+	pat, err := match.Parse(p.Pattern)
+	if err != nil {
+	    return fmt.Errorf("priorities[%d]: %v", i, err)
+	}
+	if p.Priority < 1 {
+	    return fmt.Errorf("priorities[%d]: priority %d must be positive", i, p.Priority)
+	}
+	p.pattern = pat
+    }
+    if c.TCPKeepalive.Duration <= 0 {
+	return fmt.Errorf("tcp_keepalive: %v must be positive", c.TCPKeepalive)
+    }
+    if c.Keepalive.Duration < time.Second {
+	return fmt.Errorf("keepalive: %v too short", c.Keepalive)
+    }
+    // a supply line takes keepalive, keepalive_lost and dead_timeout
+    // together when it starts, a running one keeps its old ones
+    if c.DeadTimeout.Duration < c.Keepalive.Duration {
+	return fmt.Errorf("dead_timeout: %v shorter than keepalive %v", c.DeadTimeout, c.Keepalive)
+    }
+    if c.DrainTimeout.Duration < 0 {
+	return fmt.Errorf("drain_timeout: %v must not be negative", c.DrainTimeout)
+    }
+    if c.KeepaliveLost < 1 {
+	return fmt.Errorf("keepalive_lost: %d must be positive", c.KeepaliveLost)
+    }
+    if err := c.Log.Validate(); err != nil {
+	return fmt.Errorf("log: %v", err)
+    }
+    if err := c.AccessLog.Validate(); err != nil {
+	return fmt.Errorf("access_log: %v", err)
+    }
+    return nil
+}
+
+// Check reports whether -check-config was given.
+func (c *Config)Check() bool {
+    return c.check
+}
+
+// HashPassword reports whether -hash-password was given.
+func (c *Config)HashPassword() bool {
+    return c.hashPassword
+}
+
+// ACL returns the allow/deny lists for listen.
+func (c *Config)ACL() *connection.ACL {
+    return c.acl
+}
+
+// Credentials returns the proxy users, nil when authentication is off.
+func (c *Config)Credentials() *auth.Credentials {
+    return c.credentials
+}
+
+// staged holds what c needs opened before anything running changes.
+type staged struct {
+    log *log.Setting
+    access *accesslog.Output
+}
+
+// stage opens the log outputs of c, a file is opened on every reload so
+// that a rotated log is picked up. The resolver of old is kept with its
+// cache unless the dns settings changed.
+func (c *Config)stage(old *Config) (*staged, error) {
+    if old != nil && reflect.DeepEqual(old.DNS, c.DNS) {
+	c.resolver = old.resolver
+    } else {
+	r, err := egress.NewResolver(&c.DNS)
+	if err != nil {
+	    return nil, fmt.Errorf("dns: %v", err)
+	}
+	c.resolver = r
+    }
+    l, err := log.Open(&c.Log)
+    if err != nil {
+	return nil, fmt.Errorf("log: %v", err)
+    }
+    a, err := accesslog.Open(&c.AccessLog)
+    if err != nil {
+	l.Close()
+	return nil, fmt.Errorf("access_log: %v", err)
+    }
+    return &staged{ log: l, access: a }, nil
+}
+
+func (st *staged)abort() {
+    st.log.Close()
+    st.access.Close()
+}
+
+// Apply configures logging, builds the resolver and sets the supply line
+// and TCP keepalive settings at start.
+func (c *Config)Apply() error {
+    st, err := c.stage(nil)
+    if err != nil {
+	return err
+    }
+    c.apply(st)
+    return nil
+}
+
+// apply switches to c with st from stage, it can not fail.
+func (c *Config)apply(st *staged) {
+    st.log.Use()
+    st.access.Use()
+    pac.Configure(&c.PAC, c.pacRules(), c.Listen)
+    admin.SetToken(c.AdminToken)
+    supplyline.SetKeepalive(supplyline.Keepalive{
+	Interval: c.Keepalive.Duration,
+	MaxLost: c.KeepaliveLost,
+	DeadTimeout: c.DeadTimeout.Duration,
+    })
+    connection.SetKeepAlivePeriod(c.TCPKeepalive.Duration)
+}
+
+// Limiter builds the rate limiter.
+func (c *Config)Limiter() (*ratelimit.Limiter, error) {
+    l := ratelimit.NewLimiter(0, 0)
+    if err := c.UpdateLimiter(l); err != nil {
+	return nil, err
+    }
+    return l, nil
+}
+
+// UpdateLimiter applies the rate limits to l.
+func (c *Config)UpdateLimiter(l *ratelimit.Limiter) error {
+    lr, err := ratelimit.ParseRate(c.Rate)
+    if err != nil {
+	return err
+    }
+    cr, err := ratelimit.ParseRate(c.ConnRate)
+    if err != nil {
+	return err
+    }
+    patterns := []string{}
+    rates := []int64{}
+    for _, r := range c.DestRates {
+	rate, err := ratelimit.ParseRate(r.Rate)
+	if err != nil {
+	    return err
+	}
+	patterns = append(patterns, r.Pattern)
+	rates = append(rates, rate)
+    }
+    if err := l.SetRules(patterns, rates); err != nil {
+	return err
+    }
+    l.SetRates(lr, cr)
+    return nil
+}
+
+// Changes lists the settings in n which differ from c and only take effect
+// after a restart or on the next supply line.
+func (c *Config)Changes(n *Config) []string {
+    msgs := []string{}
+    if c.Frontline != n.Frontline {
+	msgs = append(msgs, "frontline: used from the next reconnect")
+    }
+    if c.Metrics != n.Metrics {
+	msgs = append(msgs, "metrics: restart required")
+    }
+    if c.Admin != n.Admin {
+	msgs = append(msgs, "admin: restart required")
+    }
+    if c.PAC.Listen != n.PAC.Listen {
+	msgs = append(msgs, "pac: restart required")
+    }
+    if c.Keepalive != n.Keepalive || c.KeepaliveLost != n.KeepaliveLost || c.DeadTimeout != n.DeadTimeout {
+	msgs = append(msgs, "keepalive, keepalive_lost, dead_timeout: used by new supply lines, running ones keep the old interval and timeouts")
+    }
+    if c.TCPKeepalive != n.TCPKeepalive {
+	msgs = append(msgs, "tcp_keepalive: used by new connections")
+    }
+    return msgs
+}
+
+// Route returns the egress route for hostport, direct if no rule matches.
+func (c *Config)Route(hostport string) *Route {
+    for _, r := range c.Routes {
+	if r.pattern != nil && r.pattern.Match(hostport) {
+	    return r
+	}
+    }
+    return directRoute
+}
+
+// BacklineIdentity returns the name of the backline connecting from addr,
+// its IP if no backlines entry has it.
+func (c *Config)BacklineIdentity(addr string) string {
+    host, _, err := net.SplitHostPort(addr)
+    if err != nil {
+	host = addr
+    }
+    ip := net.ParseIP(host)
+    if ip == nil {
+	return host
+    }
+    for _, b := range c.Backlines {
+	for _, n := range b.nets {
+	    if n.Contains(ip) {
+		return b.Name
+	    }
+	}
+    }
+    return ip.String()
+}
+
+// EgressSource returns the source for connections of the backline
+// identity to hostport, nil for the system default.
+func (c *Config)EgressSource(backline, hostport string) *egress.Source {
+    for _, s := range c.Sources {
+	if s.match(backline, hostport) {
+	    return s.source
+	}
+    }
+    return c.source
+}
+
+// Resolver returns the DNS resolver for egress dials.
+func (c *Config)Resolver() *egress.Resolver {
+    return c.resolver
+}
+
+// Priority returns the scheduling priority for hostport.
+func (c *Config)Priority(hostport string) int {
+    for _, p := range c.Priorities {
+	if p.pattern != nil && p.pattern.Match(hostport) {
+	    return p.Priority
+	}
+    }
+    return 1
+}
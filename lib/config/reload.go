@@ -0,0 +1,106 @@
+// HTTP frontline / lib/config
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package config
+
+import (
+    "fmt"
+    "os"
+    "os/signal"
+    "sync"
+    "syscall"
+
+    "frontline/lib/connection"
+    "frontline/lib/log"
+    "frontline/lib/ratelimit"
+)
+
+// Reloader reads the configuration of backline or frontline again and
+// applies it, running supply lines and tunnels are kept.
+type Reloader struct {
+    // backline or frontline
+    Cmd string
+    Limiter *ratelimit.Limiter
+    Server *connection.Server
+    // Current returns the running configuration.
+    Current func() *Config
+    // Prepare checks and loads what the command needs for n. The func it
+    // returns makes n the running configuration and must not fail.
+    Prepare func(n *Config) (func(), error)
+    // one reload at a time, SIGHUP and the admin API
+    mu sync.Mutex
+}
+
+// Reload applies the configuration all or nothing. Outputs are opened and
+// files loaded first, nothing running changes when that fails. A listen
+// address which can not be bound is reported and the old one is kept.
+func (r *Reloader)Reload() ([]string, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    n, err := Parse(r.Cmd, os.Args[1:])
+    if err != nil {
+	return nil, err
+    }
+    old := r.Current()
+    msgs := old.Changes(n)
+    st, err := n.stage(old)
+    if err != nil {
+	return nil, err
+    }
+    commit, err := r.Prepare(n)
+    if err != nil {
+	st.abort()
+	return nil, err
+    }
+    // it checks everything before it changes the limiter
+    if err := n.UpdateLimiter(r.Limiter); err != nil {
+	st.abort()
+	return nil, err
+    }
+    n.apply(st)
+    if err := r.Server.Listen(n.Listen); err != nil {
+	msgs = append(msgs, fmt.Sprintf("listen: %v, keep %s", err, r.Server.Addr()))
+	n.Listen = r.Server.Addr()
+    }
+    r.Server.SetACL(n.ACL())
+    commit()
+    return msgs, nil
+}
+
+// HandleReload calls reload on every SIGHUP and logs the result.
+func HandleReload(reload func() ([]string, error)) {
+    q := make(chan os.Signal, 1)
+    signal.Notify(q, syscall.SIGHUP)
+    go func() {
+	for range q {
+	    tag := log.NewTag("reload")
+	    tag.Printf("SIGHUP: reload configuration")
+	    msgs, err := reload()
+	    if err != nil {
+		tag.Errorf("%v, configuration not changed", err)
+		continue
+	    }
+	    for _, m := range msgs {
+		tag.Warnf("%s", m)
+	    }
+	    tag.Printf("done")
+	}
+    }()
+}
+
+// HandleShutdown calls shutdown on SIGTERM or SIGINT and exits.
+func HandleShutdown(shutdown func()) {
+    q := make(chan os.Signal, 1)
+    signal.Notify(q, syscall.SIGTERM, os.Interrupt)
+    go func() {
+	sig := <-q
+	log.NewTag("shutdown").Printf("%v: shutdown", sig)
+	// second signal exits now
+	go func() {
+	    <-q
+	    os.Exit(1)
+	}()
+	shutdown()
+	os.Exit(0)
+    }()
+}
@@ -0,0 +1,201 @@
+// HTTP frontline / lib/config
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package config
+
+import (
+    "context"
+    "fmt"
+    "net"
+    "strconv"
+    "strings"
+
+    "frontline/lib/connection"
+    "frontline/lib/pac"
+)
+
+// SplitRule decides on backline whether a destination is dialed directly,
+// tunneled through frontline or rejected. All conditions given must match.
+type SplitRule struct {
+    // "corp.example" matches the domain and its subdomains
+    Domain string `json:"domain,omitempty"`
+    // the destination address given as an IP
+    CIDR string `json:"cidr,omitempty"`
+    // also resolve names for CIDR, the DNS servers see the names
+    Resolve bool `json:"resolve,omitempty"`
+    // "22" or "8000-8999"
+    Port string `json:"port,omitempty"`
+    // direct, tunnel or reject
+    Action string `json:"action"`
+    domain string
+    cidr *net.IPNet
+    portLo, portHi int
+}
+
+func (r *SplitRule)String() string {
+    l := []string{}
+    if r.Domain != "" {
+	l = append(l, "domain=" + r.Domain)
+    }
+    if r.CIDR != "" {
+	l = append(l, "cidr=" + r.CIDR)
+    }
+    if r.Port != "" {
+	l = append(l, "port=" + r.Port)
+    }
+    return strings.Join(l, ",")
+}
+
+func parsePortRange(s string) (int, int, error) {
+    lo, hi := s, s
+    if i := strings.Index(s, "-"); i >= 0 {
+	lo, hi = s[:i], s[i + 1:]
+    }
+    l, err := strconv.Atoi(lo)
+    if err != nil || l < 1 || l > 65535 {
+	return 0, 0, fmt.Errorf("bad port %s", s)
+    }
+    h, err := strconv.Atoi(hi)
+    if err != nil || h < l || h > 65535 {
+	return 0, 0, fmt.Errorf("bad port %s", s)
+    }
+    return l, h, nil
+}
+
+func (r *SplitRule)validate() error {
+    switch r.Action {
+    case "direct", "tunnel", "reject":
+    default:
+	return fmt.Errorf("unknown action %s", r.Action)
+    }
+    if r.Domain == "" && r.CIDR == "" && r.Port == "" {
+	return fmt.Errorf("no domain, cidr or port")
+    }
+    if r.Domain != "" {
+	r.domain = strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(r.Domain, "*"), "."))
+	if r.domain == "" {
+	    return fmt.Errorf("bad domain %s", r.Domain)
+	}
+    }
+    if r.CIDR != "" {
+	n, err := connection.ParseCIDR(r.CIDR)
+	if err != nil {
+	    return err
+	}
+	r.cidr = n
+    }
+    if r.Port != "" {
+	lo, hi, err := parsePortRange(r.Port)
+	if err != nil {
+	    return err
+	}
+	r.portLo, r.portHi = lo, hi
+    }
+    return nil
+}
+
+// match checks host and port, lookup resolves a name for a CIDR with
+// Resolve.
+func (r *SplitRule)match(host string, port int, lookup func() []net.IP) bool {
+    if r.domain != "" {
+	h := strings.ToLower(strings.TrimSuffix(host, "."))
+	if h != r.domain && !strings.HasSuffix(h, "." + r.domain) {
+	    return false
+	}
+    }
+    if r.Port != "" && (port < r.portLo || port > r.portHi) {
+	return false
+    }
+    if r.cidr != nil {
+	if ip := net.ParseIP(host); ip != nil {
+	    return r.cidr.Contains(ip)
+	}
+	if !r.Resolve {
+	    return false
+	}
+	for _, ip := range lookup() {
+	    if r.cidr.Contains(ip) {
+		return true
+	    }
+	}
+	return false
+    }
+    return true
+}
+
+// pacRules reduces the split rules to what a browser checks.
+func (c *Config)pacRules() []pac.Rule {
+    rules := []pac.Rule{}
+    for _, r := range c.Split {
+	rules = append(rules, pac.Rule{
+	    Domain: r.domain,
+	    Partial: r.CIDR != "" || r.Port != "",
+	    Direct: r.Action == "direct",
+	})
+    }
+    return rules
+}
+
+// splitFlag takes domain=action, CIDR=action or port=action.
+type splitFlag struct {
+    c *Config
+    set bool
+}
+
+func (f *splitFlag)String() string {
+    if f.c == nil {
+	return ""
+    }
+    l := []string{}
+    for _, r := range f.c.Split {
+	l = append(l, r.String() + "=" + r.Action)
+    }
+    return strings.Join(l, ",")
+}
+
+func (f *splitFlag)Set(s string) error {
+    i := strings.LastIndex(s, "=")
+    if i < 0 {
+	return fmt.Errorf("want domain|cidr|port=direct|tunnel|reject")
+    }
+    if !f.set {
+	f.c.Split = nil
+	f.set = true
+    }
+    cond := s[:i]
+    r := &SplitRule{ Action: s[i + 1:] }
+    if _, _, err := parsePortRange(cond); err == nil {
+	r.Port = cond
+    } else if _, err := connection.ParseCIDR(cond); err == nil {
+	r.CIDR = cond
+    } else {
+	r.Domain = cond
+    }
+    f.c.Split = append(f.c.Split, r)
+    return nil
+}
+
+// SplitRoute returns the action of backline for hostport, tunnel if no
+// rule matches, and the index of the rule or -1.
+func (c *Config)SplitRoute(hostport string) (string, int) {
+    host, portstr, err := net.SplitHostPort(hostport)
+    if err != nil {
+	return "tunnel", -1
+    }
+    port, _ := strconv.Atoi(portstr)
+    var ips []net.IP
+    resolved := false
+    lookup := func() []net.IP {
+	if !resolved {
+	    resolved = true
+	    ips, _ = c.resolver.Lookup(context.Background(), host)
+	}
+	return ips
+    }
+    for i, r := range c.Split {
+	if r.match(host, port, lookup) {
+	    return r.Action, i
+	}
+    }
+    return "tunnel", -1
+}
@@ -0,0 +1,109 @@
+// HTTP frontline / lib/config
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package config
+
+import (
+    "testing"
+
+    "frontline/lib/egress"
+)
+
+// splitConfig validates rules and resolves the names in hosts only.
+func splitConfig(t *testing.T, hosts map[string][]string, rules ...*SplitRule) *Config {
+    c := Default("backline")
+    c.Split = rules
+    for i, r := range rules {
+	if err := r.validate(); err != nil {
+	    t.Fatalf("split[%d]: %v", i, err)
+	}
+    }
+    c.DNS.Hosts = hosts
+    r, err := egress.NewResolver(&c.DNS)
+    if err != nil {
+	t.Fatal(err)
+    }
+    c.resolver = r
+    return c
+}
+
+func TestSplitRoute(t *testing.T) {
+    c := splitConfig(t, map[string][]string{
+	    "intranet.example": { "10.0.0.10" },
+	    "home.example": { "192.168.1.1" },
+	    "notcorp.example": { "203.0.113.1" },
+	    "ssh.example": { "203.0.113.2" },
+	},
+	&SplitRule{ Domain: "secure.corp.example", Action: "tunnel" },
+	&SplitRule{ Domain: "*.corp.example", Action: "direct" },
+	&SplitRule{ Port: "25", Action: "reject" },
+	&SplitRule{ Domain: "ssh.example", Port: "22", Action: "direct" },
+	&SplitRule{ Port: "8000-8999", Action: "direct" },
+	&SplitRule{ CIDR: "192.168.0.0/16", Action: "reject" },
+	&SplitRule{ CIDR: "10.0.0.0/8", Resolve: true, Action: "direct" },
+    )
+    tests := []struct {
+	hostport string
+	action string
+	rule int
+    }{
+	// the first match wins
+	{ "secure.corp.example:443", "tunnel", 0 },
+	{ "www.secure.corp.example:443", "tunnel", 0 },
+	{ "WWW.Corp.Example.:443", "direct", 1 },
+	{ "corp.example:443", "direct", 1 },
+	// a suffix only at a dot
+	{ "notcorp.example:443", "tunnel", -1 },
+	{ "mail.example:25", "reject", 2 },
+	{ "secure.corp.example:25", "tunnel", 0 },
+	{ "ssh.example:22", "direct", 3 },
+	{ "ssh.example:443", "tunnel", -1 },
+	{ "198.51.100.1:8000", "direct", 4 },
+	{ "198.51.100.1:8999", "direct", 4 },
+	{ "198.51.100.1:9000", "tunnel", -1 },
+	{ "192.168.1.1:443", "reject", 5 },
+	// resolved only for a rule which asks for it
+	{ "home.example:443", "tunnel", -1 },
+	{ "intranet.example:443", "direct", 6 },
+	{ "10.1.2.3:443", "direct", 6 },
+	{ "[2001:db8::1]:443", "tunnel", -1 },
+	{ "example.com", "tunnel", -1 },
+    }
+    for _, tt := range tests {
+	action, rule := c.SplitRoute(tt.hostport)
+	if action != tt.action || rule != tt.rule {
+	    t.Errorf("%s: got %s %d, want %s %d", tt.hostport, action, rule, tt.action, tt.rule)
+	}
+    }
+    // no rules, everything is tunneled
+    if action, rule := splitConfig(t, nil).SplitRoute("example.com:443"); action != "tunnel" || rule != -1 {
+	t.Errorf("no rules: got %s %d", action, rule)
+    }
+}
+
+func TestSplitFlag(t *testing.T) {
+    c := Default("backline")
+    f := &splitFlag{ c: c }
+    for _, s := range []string{ "22=direct", "8000-8999=reject", "10.0.0.0/8=direct", "corp.example=tunnel" } {
+	if err := f.Set(s); err != nil {
+	    t.Fatalf("%s: %v", s, err)
+	}
+    }
+    want := "port=22=direct,port=8000-8999=reject,cidr=10.0.0.0/8=direct,domain=corp.example=tunnel"
+    if got := f.String(); got != want {
+	t.Errorf("got %s, want %s", got, want)
+    }
+    bad := []*SplitRule{
+	{ Domain: "corp.example", Action: "drop" },
+	{ Action: "direct" },
+	{ Domain: "*.", Action: "direct" },
+	{ Port: "0", Action: "direct" },
+	{ Port: "9000-8000", Action: "direct" },
+	{ CIDR: "10.0.0.0/33", Action: "direct" },
+    }
+    for _, r := range bad {
+	if err := r.validate(); err == nil {
+	    t.Errorf("%s=%s accepted", r, r.Action)
+	}
+    }
+}
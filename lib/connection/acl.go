@@ -0,0 +1,89 @@
+// HTTP frontline / lib/connection
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package connection
+
+import (
+    "fmt"
+    "net"
+    "strings"
+)
+
+// ACL decides which peers may connect. Deny wins, an empty allow list
+// allows everyone else.
+type ACL struct {
+    allow []*net.IPNet
+    deny []*net.IPNet
+}
+
+// ParseCIDR also takes a plain address as a single host.
+func ParseCIDR(s string) (*net.IPNet, error) {
+    if !strings.Contains(s, "/") {
+	ip := net.ParseIP(s)
+	if ip == nil {
+	    return nil, fmt.Errorf("bad address %s", s)
+	}
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+	    ip, bits = ip4, 32
+	}
+	return &net.IPNet{ IP: ip, Mask: net.CIDRMask(bits, bits) }, nil
+    }
+    _, n, err := net.ParseCIDR(s)
+    return n, err
+}
+
+func parseList(list []string) ([]*net.IPNet, error) {
+    nets := []*net.IPNet{}
+    for _, s := range list {
+	n, err := ParseCIDR(s)
+	if err != nil {
+	    return nil, err
+	}
+	nets = append(nets, n)
+    }
+    return nets, nil
+}
+
+func NewACL(allow, deny []string) (*ACL, error) {
+    a, err := parseList(allow)
+    if err != nil {
+	return nil, fmt.Errorf("allow: %v", err)
+    }
+    d, err := parseList(deny)
+    if err != nil {
+	return nil, fmt.Errorf("deny: %v", err)
+    }
+    return &ACL{ allow: a, deny: d }, nil
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+    for _, n := range nets {
+	if n.Contains(ip) {
+	    return true
+	}
+    }
+    return false
+}
+
+// Permit checks the remote address. Non IP peers like unix sockets are
+// always permitted.
+func (a *ACL)Permit(addr net.Addr) bool {
+    if a == nil {
+	return true
+    }
+    var ip net.IP
+    switch addr := addr.(type) {
+    case *net.TCPAddr:
+	ip = addr.IP
+    default:
+	return true
+    }
+    if contains(a.deny, ip) {
+	return false
+    }
+    if len(a.allow) == 0 {
+	return true
+    }
+    return contains(a.allow, ip)
+}
@@ -0,0 +1,132 @@
+// HTTP frontline / lib/connection
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package connection
+
+import (
+    "net"
+    "sync"
+    "time"
+
+    "frontline/lib/log"
+    "frontline/lib/stats"
+
+    "github.com/hshimamoto/go-session"
+)
+
+func init() {
+    stats.Help("listener_denied_total", "Connections refused by the allow/deny lists.")
+}
+
+// Server is a listener whose address can be changed while running.
+// Accepted connections are not affected by the change.
+type Server struct {
+    mu sync.Mutex
+    addr string
+    listener net.Listener
+    handler func(conn net.Conn)
+    closed bool
+    acl *ACL
+    // denied logs, at most one line a second
+    lastDenied time.Time
+    suppressed int
+}
+
+func NewServer(addr string, handler func(conn net.Conn)) (*Server, error) {
+    l, err := session.Listen(addr)
+    if err != nil {
+	return nil, err
+    }
+    return &Server{
+	addr: addr,
+	listener: l,
+	handler: handler,
+    }, nil
+}
+
+func (s *Server)Addr() string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.addr
+}
+
+// Listen moves the server to addr. The old listener is kept on error.
+func (s *Server)Listen(addr string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if addr == s.addr {
+	return nil
+    }
+    l, err := session.Listen(addr)
+    if err != nil {
+	return err
+    }
+    old := s.listener
+    s.addr = addr
+    s.listener = l
+    old.Close()
+    return nil
+}
+
+// SetACL replaces the allow/deny lists, nil permits everyone.
+func (s *Server)SetACL(acl *ACL) {
+    s.mu.Lock()
+    s.acl = acl
+    s.mu.Unlock()
+}
+
+// permit is called before the handler, a port scan must not flood the log.
+func (s *Server)permit(conn net.Conn) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.acl.Permit(conn.RemoteAddr()) {
+	return true
+    }
+    stats.Counter("listener_denied_total").Inc()
+    now := time.Now()
+    if now.Sub(s.lastDenied) < time.Second {
+	s.suppressed++
+	return false
+    }
+    tag := log.NewTag("acl", "client", conn.RemoteAddr().String())
+    if s.suppressed > 0 {
+	tag = tag.With("suppressed", s.suppressed)
+    }
+    tag.Warnf("denied")
+    s.lastDenied = now
+    s.suppressed = 0
+    return false
+}
+
+func (s *Server)Close() {
+    s.mu.Lock()
+    s.closed = true
+    s.listener.Close()
+    s.mu.Unlock()
+}
+
+func (s *Server)Run() {
+    for {
+	s.mu.Lock()
+	l := s.listener
+	s.mu.Unlock()
+	conn, err := l.Accept()
+	if err != nil {
+	    s.mu.Lock()
+	    closed, moved := s.closed, s.listener != l
+	    s.mu.Unlock()
+	    if closed {
+		return
+	    }
+	    if !moved {
+		time.Sleep(time.Millisecond * 100)
+	    }
+	    continue
+	}
+	if !s.permit(conn) {
+	    conn.Close()
+	    continue
+	}
+	go s.handler(conn)
+    }
+}
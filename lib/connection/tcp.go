@@ -6,9 +6,26 @@ package connection
 import (
     "fmt"
     "net"
+    "sync/atomic"
     "time"
+
+    "github.com/hshimamoto/go-session"
 )
 
+// keepAlivePeriod is the TCP keepalive period, read and set atomically.
+var keepAlivePeriod = int64(time.Minute)
+
+// SetKeepAlivePeriod sets the period for the connections enabled from now.
+func SetKeepAlivePeriod(d time.Duration) {
+    atomic.StoreInt64(&keepAlivePeriod, int64(d))
+}
+
+// Dial connects to addr like session.Dial and gives up after timeout.
+func Dial(addr string, timeout time.Duration) (net.Conn, error) {
+    proto, addr := session.GetProtoAddr(addr)
+    return net.DialTimeout(proto, addr, timeout)
+}
+
 func EnableKeepAlive(conn net.Conn) error {
     tc, ok := conn.(*net.TCPConn)
     if !ok {
@@ -17,7 +34,7 @@ func EnableKeepAlive(conn net.Conn) error {
     if err := tc.SetKeepAlive(true); err != nil {
 	return err
     }
-    if err := tc.SetKeepAlivePeriod(time.Minute); err != nil {
+    if err := tc.SetKeepAlivePeriod(time.Duration(atomic.LoadInt64(&keepAlivePeriod))); err != nil {
 	return err
     }
     return nil
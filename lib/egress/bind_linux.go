@@ -0,0 +1,29 @@
+// HTTP frontline / lib/egress
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//go:build linux
+// +build linux
+
+package egress
+
+import (
+    "syscall"
+)
+
+func checkDevice() error {
+    return nil
+}
+
+// bindDevice returns a net.Dialer Control which sets SO_BINDTODEVICE.
+func bindDevice(device string) func(network, address string, c syscall.RawConn) error {
+    return func(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+	    serr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
+	})
+	if err != nil {
+	    return err
+	}
+	return serr
+    }
+}
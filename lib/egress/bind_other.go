@@ -0,0 +1,20 @@
+// HTTP frontline / lib/egress
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//go:build !linux
+// +build !linux
+
+package egress
+
+import (
+    "fmt"
+    "syscall"
+)
+
+func checkDevice() error {
+    return fmt.Errorf("device binding is only supported on linux")
+}
+
+func bindDevice(device string) func(network, address string, c syscall.RawConn) error {
+    return nil
+}
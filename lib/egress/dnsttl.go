@@ -0,0 +1,114 @@
+// HTTP frontline / lib/egress
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package egress
+
+import (
+    "net"
+    "sync"
+    "time"
+
+    "golang.org/x/net/dns/dnsmessage"
+)
+
+// ttlKey carries a ttlCollector in the context of a lookup to the Dial of
+// the Go resolver.
+type ttlKey struct{}
+
+// ttlCollector keeps the lowest TTL of the answers to one lookup, the A
+// and AAAA queries run at the same time.
+type ttlCollector struct {
+    mu sync.Mutex
+    ttl uint32
+    found bool
+}
+
+func (t *ttlCollector)parse(msg []byte) {
+    var p dnsmessage.Parser
+    if _, err := p.Start(msg); err != nil {
+	return
+    }
+    if err := p.SkipAllQuestions(); err != nil {
+	return
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    for {
+	h, err := p.AnswerHeader()
+	if err != nil {
+	    return
+	}
+	// a CNAME on the way counts too
+	if !t.found || h.TTL < t.ttl {
+	    t.ttl, t.found = h.TTL, true
+	}
+	if err := p.SkipAnswer(); err != nil {
+	    return
+	}
+    }
+}
+
+// get returns the TTL, false if no answer was seen like for static hosts.
+func (t *ttlCollector)get() (time.Duration, bool) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return time.Duration(t.ttl) * time.Second, t.found
+}
+
+// ttlConn passes the DNS responses read to the collector. Over TCP they
+// are prefixed with the length, over UDP one is read at once.
+type ttlConn struct {
+    net.Conn
+    stream bool
+    buf []byte
+    ttl *ttlCollector
+}
+
+func (c *ttlConn)Read(b []byte) (int, error) {
+    n, err := c.Conn.Read(b)
+    if n <= 0 {
+	return n, err
+    }
+    if !c.stream {
+	c.ttl.parse(b[:n])
+	return n, err
+    }
+    c.buf = append(c.buf, b[:n]...)
+    for len(c.buf) >= 2 {
+	l := int(c.buf[0]) << 8 | int(c.buf[1])
+	if len(c.buf) < 2 + l {
+	    break
+	}
+	c.ttl.parse(c.buf[2:2 + l])
+	c.buf = c.buf[2 + l:]
+    }
+    return n, err
+}
+
+// ttlPacketConn keeps the UDP conn a PacketConn, the Go resolver frames
+// its messages by that.
+type ttlPacketConn struct {
+    *ttlConn
+}
+
+func (c ttlPacketConn)ReadFrom(b []byte) (int, net.Addr, error) {
+    n, err := c.Read(b)
+    return n, c.RemoteAddr(), err
+}
+
+func (c ttlPacketConn)WriteTo(b []byte, addr net.Addr) (int, error) {
+    return c.Write(b)
+}
+
+// withTTL wraps conn when the lookup collects the TTL.
+func withTTL(conn net.Conn, col *ttlCollector) net.Conn {
+    if col == nil {
+	return conn
+    }
+    c := &ttlConn{ Conn: conn, ttl: col }
+    if _, ok := conn.(net.PacketConn); ok {
+	return ttlPacketConn{ c }
+    }
+    c.stream = true
+    return c
+}
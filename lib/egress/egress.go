@@ -0,0 +1,181 @@
+// HTTP frontline / lib/egress
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package egress
+
+import (
+    "context"
+    "fmt"
+    "net"
+    "net/url"
+    "time"
+
+    "frontline/lib/connection"
+)
+
+// ParseProxy checks an upstream proxy URL, http://[user:pass@]host:port or
+// socks5://[user:pass@]host:port.
+func ParseProxy(s string) (*url.URL, error) {
+    u, err := url.Parse(s)
+    if err != nil {
+	return nil, err
+    }
+    switch u.Scheme {
+    case "http", "socks5":
+    default:
+	return nil, fmt.Errorf("proxy %s: want http or socks5", s)
+    }
+    if _, _, err := net.SplitHostPort(u.Host); err != nil {
+	return nil, fmt.Errorf("proxy %s: %v", s, err)
+    }
+    return u, nil
+}
+
+// Dialer connects to destinations for frontline.
+type Dialer struct {
+    // for the whole dial including the proxy handshake
+    Timeout time.Duration
+    // local address and device, nil for the default
+    Source *Source
+    // nil lets net.Dial resolve
+    Resolver *Resolver
+    // for one address of a resolved destination, 0 for no limit
+    AttemptTimeout time.Duration
+}
+
+// AttemptDelay is how long a connection attempt runs before the next
+// address is tried in parallel (RFC 8305 section 5).
+var AttemptDelay = 250 * time.Millisecond
+
+type attempt struct {
+    conn net.Conn
+    err error
+}
+
+func (d *Dialer)dial(addr string) (net.Conn, error) {
+    host, port, err := net.SplitHostPort(addr)
+    if d.Source == nil && (d.Resolver == nil || err != nil) {
+	return connection.Dial(addr, d.Timeout)
+    }
+    nd := &net.Dialer{ Timeout: d.Timeout }
+    local := d.Source.localAddr()
+    if local != nil {
+	nd.LocalAddr = local
+    }
+    if d.Source != nil && d.Source.device != "" {
+	nd.Control = bindDevice(d.Source.device)
+    }
+    if d.Resolver == nil || err != nil {
+	return nd.Dial("tcp", addr)
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
+    defer cancel()
+    ips, err := d.Resolver.Lookup(ctx, host)
+    if err != nil {
+	return nil, err
+    }
+    // skip the family the source can not use
+    addrs := []string{}
+    for _, ip := range ips {
+	if local != nil && (local.IP.To4() == nil) != (ip.To4() == nil) {
+	    continue
+	}
+	addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+    }
+    if len(addrs) == 0 {
+	return nil, fmt.Errorf("%s: no usable address", host)
+    }
+    return d.race(ctx, nd, addrs)
+}
+
+// race connects to addrs in order, starting the next one when an attempt
+// fails or takes longer than AttemptDelay. The first connection wins.
+func (d *Dialer)race(ctx context.Context, nd *net.Dialer, addrs []string) (net.Conn, error) {
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    results := make(chan attempt, len(addrs))
+    start := func(addr string) {
+	actx := ctx
+	if d.AttemptTimeout > 0 {
+	    var acancel context.CancelFunc
+	    actx, acancel = context.WithTimeout(ctx, d.AttemptTimeout)
+	    defer acancel()
+	}
+	conn, err := nd.DialContext(actx, "tcp", addr)
+	results <- attempt{ conn: conn, err: err }
+    }
+    next, running := 0, 0
+    // close the connections of attempts still running
+    drain := func(n int) {
+	for ; n > 0; n-- {
+	    if r := <-results; r.err == nil {
+		r.conn.Close()
+	    }
+	}
+    }
+    var err error
+    timer := time.NewTimer(0)
+    defer timer.Stop()
+    for {
+	select {
+	case <-timer.C:
+	    if next < len(addrs) {
+		go start(addrs[next])
+		next++
+		running++
+		timer.Reset(AttemptDelay)
+	    }
+	    continue
+	case r := <-results:
+	    running--
+	    if r.err == nil {
+		go drain(running)
+		return r.conn, nil
+	    }
+	    err = r.err
+	case <-ctx.Done():
+	    go drain(running)
+	    if err == nil {
+		err = ctx.Err()
+	    }
+	    return nil, err
+	}
+	// failed, go on with the next address at once
+	if next < len(addrs) {
+	    if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	    }
+	    timer.Reset(0)
+	} else if running == 0 {
+	    return nil, err
+	}
+    }
+}
+
+// Dial connects to hostport directly or through proxy when it is not nil.
+func (d *Dialer)Dial(hostport string, proxy *url.URL) (net.Conn, error) {
+    if proxy == nil {
+	return d.dial(hostport)
+    }
+    deadline := time.Now().Add(d.Timeout)
+    conn, err := d.dial(proxy.Host)
+    if err != nil {
+	return nil, err
+    }
+    conn.SetDeadline(deadline)
+    switch proxy.Scheme {
+    case "socks5":
+	err = socks5Connect(conn, proxy, hostport)
+    default:
+	err = httpConnect(conn, proxy, hostport)
+    }
+    if err != nil {
+	conn.Close()
+	return nil, err
+    }
+    conn.SetDeadline(time.Time{})
+    return conn, nil
+}
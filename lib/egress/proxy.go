@@ -0,0 +1,154 @@
+// HTTP frontline / lib/egress
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package egress
+
+import (
+    "bufio"
+    "encoding/base64"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "strconv"
+)
+
+// httpConnect asks an HTTP proxy on conn for a tunnel to hostport.
+func httpConnect(conn net.Conn, proxy *url.URL, hostport string) error {
+    req := "CONNECT " + hostport + " HTTP/1.1\r\nHost: " + hostport + "\r\n"
+    if u := proxy.User; u != nil {
+	pass, _ := u.Password()
+	cred := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + pass))
+	req += "Proxy-Authorization: Basic " + cred + "\r\n"
+    }
+    req += "\r\n"
+    if _, err := io.WriteString(conn, req); err != nil {
+	return err
+    }
+    // read byte by byte, nothing of the tunnel may be buffered here
+    resp, err := http.ReadResponse(bufio.NewReaderSize(byteReader{ conn }, 16), nil)
+    if err != nil {
+	return err
+    }
+    if resp.StatusCode != http.StatusOK {
+	return fmt.Errorf("proxy %s: %s", proxy.Host, resp.Status)
+    }
+    return nil
+}
+
+// byteReader reads one byte at a time.
+type byteReader struct {
+    r io.Reader
+}
+
+func (b byteReader)Read(p []byte) (int, error) {
+    if len(p) > 1 {
+	p = p[:1]
+    }
+    return b.r.Read(p)
+}
+
+var socksErrors = []string{
+    "succeeded",
+    "general SOCKS server failure",
+    "connection not allowed by ruleset",
+    "network unreachable",
+    "host unreachable",
+    "connection refused",
+    "TTL expired",
+    "command not supported",
+    "address type not supported",
+}
+
+// socks5Connect asks a SOCKS5 proxy (RFC 1928) on conn for a tunnel to
+// hostport, with username/password (RFC 1929) if the URL has them.
+func socks5Connect(conn net.Conn, proxy *url.URL, hostport string) error {
+    host, portstr, err := net.SplitHostPort(hostport)
+    if err != nil {
+	return err
+    }
+    port, err := strconv.Atoi(portstr)
+    if err != nil || port < 1 || port > 65535 {
+	return fmt.Errorf("bad port %s", portstr)
+    }
+    method := byte(0)
+    if proxy.User != nil {
+	method = 2
+    }
+    if _, err := conn.Write([]byte{ 5, 1, method }); err != nil {
+	return err
+    }
+    buf := make([]byte, 4)
+    if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+	return err
+    }
+    if buf[0] != 5 || buf[1] != method {
+	return fmt.Errorf("socks5 %s: method rejected", proxy.Host)
+    }
+    if method == 2 {
+	user := proxy.User.Username()
+	pass, _ := proxy.User.Password()
+	if len(user) > 255 || len(pass) > 255 {
+	    return fmt.Errorf("socks5 %s: credentials too long", proxy.Host)
+	}
+	req := []byte{ 1, byte(len(user)) }
+	req = append(req, user...)
+	req = append(req, byte(len(pass)))
+	req = append(req, pass...)
+	if _, err := conn.Write(req); err != nil {
+	    return err
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+	    return err
+	}
+	if buf[1] != 0 {
+	    return fmt.Errorf("socks5 %s: authentication failed", proxy.Host)
+	}
+    }
+    req := []byte{ 5, 1, 0 }
+    if ip := net.ParseIP(host); ip != nil {
+	if ip4 := ip.To4(); ip4 != nil {
+	    req = append(req, 1)
+	    req = append(req, ip4...)
+	} else {
+	    req = append(req, 4)
+	    req = append(req, ip...)
+	}
+    } else {
+	if len(host) > 255 {
+	    return fmt.Errorf("host name too long")
+	}
+	req = append(req, 3, byte(len(host)))
+	req = append(req, host...)
+    }
+    req = append(req, byte(port >> 8), byte(port))
+    if _, err := conn.Write(req); err != nil {
+	return err
+    }
+    if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+	return err
+    }
+    if buf[1] != 0 {
+	msg := "unknown error"
+	if int(buf[1]) < len(socksErrors) {
+	    msg = socksErrors[buf[1]]
+	}
+	return fmt.Errorf("socks5 %s: %s", proxy.Host, msg)
+    }
+    // skip the bound address
+    var skip int
+    switch buf[3] {
+    case 1: skip = 4
+    case 4: skip = 16
+    case 3:
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+	    return err
+	}
+	skip = int(buf[0])
+    default:
+	return fmt.Errorf("socks5 %s: bad address type %d", proxy.Host, buf[3])
+    }
+    _, err = io.ReadFull(conn, make([]byte, skip + 2))
+    return err
+}
@@ -0,0 +1,303 @@
+// HTTP frontline / lib/egress
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package egress
+
+import (
+    "container/list"
+    "context"
+    "fmt"
+    "net"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "frontline/lib/stats"
+)
+
+func init() {
+    stats.Help("dns_lookups_total", "Host name lookups by result (hit, miss, static, negative, error).")
+}
+
+// ResolverConfig is the DNS configuration of frontline.
+type ResolverConfig struct {
+    // host:port of DNS servers, the system resolver if empty
+    Servers []string `json:"servers"`
+    // query the servers over TCP
+    TCP bool `json:"tcp"`
+    // per lookup
+    Timeout string `json:"timeout"`
+    // static host names
+    Hosts map[string][]string `json:"hosts"`
+    // how long answers and not found names are kept, 0 disables, answers
+    // at most for the TTL of the records
+    CacheTTL string `json:"cache_ttl"`
+    NegativeTTL string `json:"negative_ttl"`
+    // names kept, the least recently used go first
+    CacheSize int `json:"cache_size"`
+    // ipv4, ipv6 or empty to keep the order of the answer
+    Prefer string `json:"prefer"`
+}
+
+// DefaultCacheSize is used when cache_size is not given.
+const DefaultCacheSize = 4096
+
+type cacheEntry struct {
+    name string
+    ips []net.IP
+    err error
+    expire time.Time
+}
+
+// Resolver looks up destinations with caching and static hosts.
+type Resolver struct {
+    r *net.Resolver
+    timeout time.Duration
+    hosts map[string][]net.IP
+    ttl, negativeTTL time.Duration
+    prefer string
+    mu sync.Mutex
+    // LRU of *cacheEntry, the most recent in front
+    cache map[string]*list.Element
+    lru *list.List
+    size int
+    swept time.Time
+}
+
+func parseDuration(name, s string) (time.Duration, error) {
+    if s == "" {
+	return 0, nil
+    }
+    d, err := time.ParseDuration(s)
+    if err != nil {
+	return 0, fmt.Errorf("%s: %v", name, err)
+    }
+    if d < 0 {
+	return 0, fmt.Errorf("%s: %v must not be negative", name, d)
+    }
+    return d, nil
+}
+
+// server adds the default port to a server without one.
+func server(s string) (string, error) {
+    if _, _, err := net.SplitHostPort(s); err != nil {
+	s = net.JoinHostPort(s, "53")
+    }
+    if _, _, err := net.SplitHostPort(s); err != nil {
+	return "", fmt.Errorf("servers: %v", err)
+    }
+    return s, nil
+}
+
+func (c *ResolverConfig)Validate() error {
+    if c.CacheSize < 0 {
+	return fmt.Errorf("cache_size: must not be negative")
+    }
+    for name, s := range map[string]string{ "timeout": c.Timeout, "cache_ttl": c.CacheTTL, "negative_ttl": c.NegativeTTL } {
+	if _, err := parseDuration(name, s); err != nil {
+	    return err
+	}
+    }
+    switch c.Prefer {
+    case "", "ipv4", "ipv6":
+    default:
+	return fmt.Errorf("prefer: want ipv4 or ipv6")
+    }
+    for name, addrs := range c.Hosts {
+	for _, a := range addrs {
+	    if net.ParseIP(a) == nil {
+		return fmt.Errorf("hosts: %s: bad address %s", name, a)
+	    }
+	}
+    }
+    for _, s := range c.Servers {
+	if _, err := server(s); err != nil {
+	    return err
+	}
+    }
+    return nil
+}
+
+// NewResolver builds a resolver with an empty cache for c.
+func NewResolver(c *ResolverConfig) (*Resolver, error) {
+    if err := c.Validate(); err != nil {
+	return nil, err
+    }
+    r := &Resolver{
+	r: net.DefaultResolver,
+	hosts: map[string][]net.IP{},
+	cache: map[string]*list.Element{},
+	lru: list.New(),
+	size: c.CacheSize,
+	prefer: c.Prefer,
+    }
+    if r.size == 0 {
+	r.size = DefaultCacheSize
+    }
+    r.timeout, _ = parseDuration("timeout", c.Timeout)
+    r.ttl, _ = parseDuration("cache_ttl", c.CacheTTL)
+    r.negativeTTL, _ = parseDuration("negative_ttl", c.NegativeTTL)
+    for name, addrs := range c.Hosts {
+	name = strings.ToLower(name)
+	for _, a := range addrs {
+	    r.hosts[name] = append(r.hosts[name], net.ParseIP(a))
+	}
+    }
+    servers := []string{}
+    network := ""
+    if len(c.Servers) > 0 {
+	for _, s := range c.Servers {
+	    s, _ = server(s)
+	    servers = append(servers, s)
+	}
+	if c.TCP {
+	    network = "tcp"
+	}
+    }
+    var next uint32
+    // the Go resolver, its responses tell the TTL
+    r.r = &net.Resolver{
+	PreferGo: true,
+	Dial: func(ctx context.Context, n, address string) (net.Conn, error) {
+	    if network != "" {
+		n = network
+	    }
+	    if len(servers) > 0 {
+		// the Go resolver retries, rotate through our servers
+		i := int(atomic.AddUint32(&next, 1) - 1) % len(servers)
+		address = servers[i]
+	    }
+	    var d net.Dialer
+	    conn, err := d.DialContext(ctx, n, address)
+	    if err != nil {
+		return nil, err
+	    }
+	    col, _ := ctx.Value(ttlKey{}).(*ttlCollector)
+	    return withTTL(conn, col), nil
+	},
+    }
+    return r, nil
+}
+
+// Lookup returns the addresses of host in dial order.
+func (r *Resolver)Lookup(ctx context.Context, host string) ([]net.IP, error) {
+    if ip := net.ParseIP(host); ip != nil {
+	return []net.IP{ ip }, nil
+    }
+    name := strings.ToLower(host)
+    if ips, ok := r.hosts[name]; ok {
+	stats.Counter("dns_lookups_total", "result", "static").Inc()
+	return r.order(ips), nil
+    }
+    r.mu.Lock()
+    var e *cacheEntry
+    el, ok := r.cache[name]
+    if ok {
+	e = el.Value.(*cacheEntry)
+	if time.Now().After(e.expire) {
+	    r.remove(el)
+	    ok = false
+	} else {
+	    r.lru.MoveToFront(el)
+	}
+    }
+    r.mu.Unlock()
+    if ok {
+	if e.err != nil {
+	    stats.Counter("dns_lookups_total", "result", "negative").Inc()
+	    return nil, e.err
+	}
+	stats.Counter("dns_lookups_total", "result", "hit").Inc()
+	return r.order(e.ips), nil
+    }
+    if r.timeout > 0 {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+    }
+    col := &ttlCollector{}
+    addrs, err := r.r.LookupIPAddr(context.WithValue(ctx, ttlKey{}, col), host)
+    if err != nil {
+	stats.Counter("dns_lookups_total", "result", "error").Inc()
+	if dnserr, ok := err.(*net.DNSError); ok && dnserr.IsNotFound && r.negativeTTL > 0 {
+	    r.store(&cacheEntry{ name: name, err: err, expire: time.Now().Add(r.negativeTTL) })
+	}
+	return nil, err
+    }
+    stats.Counter("dns_lookups_total", "result", "miss").Inc()
+    ips := []net.IP{}
+    for _, a := range addrs {
+	ips = append(ips, a.IP)
+    }
+    ttl := r.ttl
+    if t, ok := col.get(); ok && t < ttl {
+	ttl = t
+    }
+    if ttl > 0 {
+	r.store(&cacheEntry{ name: name, ips: ips, expire: time.Now().Add(ttl) })
+    }
+    return r.order(ips), nil
+}
+
+// store adds e, the least recently used entries are dropped over the size
+// and expired ones once a minute.
+func (r *Resolver)store(e *cacheEntry) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if el, ok := r.cache[e.name]; ok {
+	r.remove(el)
+    }
+    r.cache[e.name] = r.lru.PushFront(e)
+    for r.lru.Len() > r.size {
+	r.remove(r.lru.Back())
+    }
+    now := time.Now()
+    if now.Sub(r.swept) < time.Minute {
+	return
+    }
+    r.swept = now
+    for el := r.lru.Back(); el != nil; {
+	prev := el.Prev()
+	if now.After(el.Value.(*cacheEntry).expire) {
+	    r.remove(el)
+	}
+	el = prev
+    }
+}
+
+// remove drops el from the cache, r.mu must be held.
+func (r *Resolver)remove(el *list.Element) {
+    e := r.lru.Remove(el).(*cacheEntry)
+    delete(r.cache, e.name)
+}
+
+// order alternates the families starting with the preferred one as in
+// RFC 8305 section 4.
+func (r *Resolver)order(ips []net.IP) []net.IP {
+    v4, v6 := []net.IP{}, []net.IP{}
+    for _, ip := range ips {
+	if ip.To4() != nil {
+	    v4 = append(v4, ip)
+	} else {
+	    v6 = append(v6, ip)
+	}
+    }
+    first, second := v6, v4
+    switch {
+    case r.prefer == "ipv4":
+	first, second = v4, v6
+    case r.prefer == "" && len(ips) > 0 && ips[0].To4() != nil:
+	first, second = v4, v6
+    }
+    list := []net.IP{}
+    for i := 0; i < len(first) || i < len(second); i++ {
+	if i < len(first) {
+	    list = append(list, first[i])
+	}
+	if i < len(second) {
+	    list = append(list, second[i])
+	}
+    }
+    return list
+}
@@ -0,0 +1,65 @@
+// HTTP frontline / lib/egress
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package egress
+
+import (
+    "fmt"
+    "net"
+    "sync/atomic"
+)
+
+// Source is the local side of egress dials: an address pool and/or a
+// network interface.
+type Source struct {
+    addrs []net.IP
+    device string
+    roundRobin bool
+    next uint32
+}
+
+func NewSource(addrs []string, device string, roundRobin bool) (*Source, error) {
+    s := &Source{ device: device, roundRobin: roundRobin }
+    for _, a := range addrs {
+	ip := net.ParseIP(a)
+	if ip == nil {
+	    return nil, fmt.Errorf("bad source address %s", a)
+	}
+	s.addrs = append(s.addrs, ip)
+    }
+    if device != "" {
+	if err := checkDevice(); err != nil {
+	    return nil, err
+	}
+    }
+    return s, nil
+}
+
+// localAddr returns the address for the next dial, nil for any.
+func (s *Source)localAddr() *net.TCPAddr {
+    if s == nil || len(s.addrs) == 0 {
+	return nil
+    }
+    i := 0
+    if s.roundRobin {
+	i = int(atomic.AddUint32(&s.next, 1) - 1) % len(s.addrs)
+    }
+    return &net.TCPAddr{ IP: s.addrs[i] }
+}
+
+func (s *Source)String() string {
+    if s == nil {
+	return "default"
+    }
+    str := ""
+    for _, a := range s.addrs {
+	if str != "" {
+	    str += ","
+	}
+	str += a.String()
+    }
+    if s.device != "" {
+	str += "%" + s.device
+    }
+    return str
+}
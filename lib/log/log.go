@@ -4,50 +4,283 @@
 package log
 
 import (
+    "encoding/json"
     "fmt"
-    "log"
+    "io"
     "os"
+    "strings"
+    "sync"
+    "time"
 )
 
-func Setup(cmd string) {
-    log.SetFlags(log.Flags() | log.Lmsgprefix)
-    log.SetPrefix(fmt.Sprintf("[%d <%s>] ", os.Getpid(), cmd))
+type Level int
+
+const (
+    Debug Level = iota
+    Info
+    Warn
+    Error
+)
+
+var levelNames = []string{ "debug", "info", "warn", "error" }
+
+func (l Level)String() string {
+    if l < Debug || l > Error {
+	return fmt.Sprintf("level(%d)", int(l))
+    }
+    return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+    for i, name := range levelNames {
+	if strings.ToLower(s) == name {
+	    return Level(i), nil
+	}
+    }
+    return Info, fmt.Errorf("unknown log level %s", s)
+}
+
+// writer receives formatted lines, syslog wants the level too.
+type writer interface {
+    write(lv Level, line string) error
+    Close() error
+}
+
+type streamWriter struct {
+    w io.Writer
+}
+
+func (s *streamWriter)write(lv Level, line string) error {
+    _, err := io.WriteString(s.w, line)
+    return err
+}
+
+func (s *streamWriter)Close() error {
+    if c, ok := s.w.(io.Closer); ok && s.w != os.Stderr {
+	return c.Close()
+    }
+    return nil
+}
+
+var (
+    lock sync.Mutex
+    prefix = ""
+    cmd = ""
+    level = Info
+    subLevels = map[string]Level{}
+    jsonFormat = false
+    out writer = &streamWriter{ w: os.Stderr }
+)
+
+func Setup(c string) {
+    lock.Lock()
+    defer lock.Unlock()
+    cmd = c
+    prefix = fmt.Sprintf("[%d <%s>] ", os.Getpid(), cmd)
+}
+
+// Config is the logging configuration.
+type Config struct {
+    // debug, info, warn or error
+    Level string `json:"level"`
+    // per tag level
+    Levels map[string]string `json:"levels"`
+    // text or json
+    Format string `json:"format"`
+    // stderr, syslog or a file path
+    Output string `json:"output"`
+}
+
+func (c *Config)Validate() error {
+    if _, err := ParseLevel(c.Level); err != nil {
+	return err
+    }
+    for sub, lv := range c.Levels {
+	if _, err := ParseLevel(lv); err != nil {
+	    return fmt.Errorf("%s: %v", sub, err)
+	}
+    }
+    switch c.Format {
+    case "text", "json":
+    default:
+	return fmt.Errorf("unknown log format %s", c.Format)
+    }
+    return nil
+}
+
+func openOutput(output string) (writer, error) {
+    switch output {
+    case "", "stderr":
+	return &streamWriter{ w: os.Stderr }, nil
+    case "syslog":
+	return openSyslog(cmd)
+    }
+    f, err := os.OpenFile(output, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+    if err != nil {
+	return nil, err
+    }
+    return &streamWriter{ w: f }, nil
+}
+
+// Setting is a validated Config with its output open, logging goes on
+// as before until Use.
+type Setting struct {
+    w writer
+    level Level
+    subs map[string]Level
+    json bool
+}
+
+// Open validates c and opens its output.
+func Open(c *Config) (*Setting, error) {
+    if err := c.Validate(); err != nil {
+	return nil, err
+    }
+    w, err := openOutput(c.Output)
+    if err != nil {
+	return nil, err
+    }
+    s := &Setting{ w: w, subs: map[string]Level{}, json: c.Format == "json" }
+    s.level, _ = ParseLevel(c.Level)
+    for sub, lv := range c.Levels {
+	s.subs[sub], _ = ParseLevel(lv)
+    }
+    return s, nil
+}
+
+// Use switches logging to s and closes the output used so far.
+func (s *Setting)Use() {
+    lock.Lock()
+    old := out
+    out = s.w
+    level = s.level
+    subLevels = s.subs
+    jsonFormat = s.json
+    lock.Unlock()
+    old.Close()
+}
+
+// Close drops s without using it.
+func (s *Setting)Close() {
+    s.w.Close()
+}
+
+func enabled(sub string, lv Level) bool {
+    lock.Lock()
+    defer lock.Unlock()
+    if l, ok := subLevels[sub]; ok {
+	return lv >= l
+    }
+    return lv >= level
+}
+
+func output(sub string, lv Level, msg string, fields []interface{}) {
+    msg = strings.TrimRight(msg, "\n")
+    now := time.Now()
+    lock.Lock()
+    defer lock.Unlock()
+    var line string
+    if jsonFormat {
+	m := map[string]interface{}{}
+	for i := 0; i + 1 < len(fields); i += 2 {
+	    m[fmt.Sprintf("%v", fields[i])] = fields[i + 1]
+	}
+	m["time"] = now.Format(time.RFC3339Nano)
+	m["level"] = lv.String()
+	m["pid"] = os.Getpid()
+	m["cmd"] = cmd
+	if sub != "" {
+	    m["tag"] = sub
+	}
+	m["msg"] = msg
+	b, err := json.Marshal(m)
+	if err != nil {
+	    b, _ = json.Marshal(map[string]string{ "msg": msg, "error": err.Error() })
+	}
+	line = string(b) + "\n"
+    } else {
+	s := now.Format("2006/01/02 15:04:05 ") + prefix
+	if lv != Info {
+	    s += strings.ToUpper(lv.String()) + " "
+	}
+	if sub != "" {
+	    s += sub + ": "
+	}
+	s += msg
+	for i := 0; i + 1 < len(fields); i += 2 {
+	    s += fmt.Sprintf(" %v=%v", fields[i], fields[i + 1])
+	}
+	line = s + "\n"
+    }
+    out.write(lv, line)
 }
 
 func Println(v ...interface{}) {
-    log.Println(v...)
+    if enabled("", Info) {
+	output("", Info, fmt.Sprintln(v...), nil)
+    }
 }
 
 func Printf(format string, v ...interface{}) {
-    log.Printf(format, v...)
+    if enabled("", Info) {
+	output("", Info, fmt.Sprintf(format, v...), nil)
+    }
+}
+
+func Debugf(format string, v ...interface{}) {
+    if enabled("", Debug) {
+	output("", Debug, fmt.Sprintf(format, v...), nil)
+    }
+}
+
+func Warnf(format string, v ...interface{}) {
+    if enabled("", Warn) {
+	output("", Warn, fmt.Sprintf(format, v...), nil)
+    }
+}
+
+func Errorf(format string, v ...interface{}) {
+    if enabled("", Error) {
+	output("", Error, fmt.Sprintf(format, v...), nil)
+    }
 }
 
-type tag interface {
-    Printf(format string, v ...interface{})
+// Tag logs for a subsystem with structured fields.
+type Tag struct {
+    sub string
+    fields []interface{}
 }
 
-type tagString struct {
-    s string
+// NewTag returns a logger for the subsystem sub. kv are key value pairs
+// added to every line.
+func NewTag(sub string, kv ...interface{}) *Tag {
+    return &Tag{ sub: sub, fields: kv }
 }
 
-type tagFunc struct {
-    f func() string
+// With returns a Tag with more fields.
+func (t *Tag)With(kv ...interface{}) *Tag {
+    fields := append([]interface{}{}, t.fields...)
+    return &Tag{ sub: t.sub, fields: append(fields, kv...) }
 }
 
-func NewTag(t interface{}) tag {
-    switch t := t.(type) {
-    case string: return &tagString{ s:t }
-    case func() string: return &tagFunc{ f:t }
-    default: return nil
+func (t *Tag)logf(lv Level, format string, v ...interface{}) {
+    if enabled(t.sub, lv) {
+	output(t.sub, lv, fmt.Sprintf(format, v...), t.fields)
     }
 }
 
-func (t *tagString)Printf(format string, v ...interface{}) {
-    msg := fmt.Sprintf(format, v...)
-    Printf("%s: %s", t.s, msg)
+func (t *Tag)Printf(format string, v ...interface{}) {
+    t.logf(Info, format, v...)
+}
+
+func (t *Tag)Debugf(format string, v ...interface{}) {
+    t.logf(Debug, format, v...)
+}
+
+func (t *Tag)Warnf(format string, v ...interface{}) {
+    t.logf(Warn, format, v...)
 }
 
-func (t *tagFunc)Printf(format string, v ...interface{}) {
-    msg := fmt.Sprintf(format, v...)
-    Printf("%s: %s", t.f(), msg)
+func (t *Tag)Errorf(format string, v ...interface{}) {
+    t.logf(Error, format, v...)
 }
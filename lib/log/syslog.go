@@ -0,0 +1,41 @@
+// HTTP frontline / lib/log
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package log
+
+import (
+    "log/syslog"
+    "strings"
+)
+
+type syslogWriter struct {
+    w *syslog.Writer
+}
+
+func openSyslog(tag string) (writer, error) {
+    w, err := syslog.New(syslog.LOG_INFO | syslog.LOG_DAEMON, tag)
+    if err != nil {
+	return nil, err
+    }
+    return &syslogWriter{ w: w }, nil
+}
+
+func (s *syslogWriter)write(lv Level, line string) error {
+    // syslog has its own timestamp
+    if i := strings.Index(line, "] "); i > 0 && line[0] != '{' {
+	line = line[i + 2:]
+    }
+    switch lv {
+    case Debug: return s.w.Debug(line)
+    case Warn: return s.w.Warning(line)
+    case Error: return s.w.Err(line)
+    }
+    return s.w.Info(line)
+}
+
+func (s *syslogWriter)Close() error {
+    return s.w.Close()
+}
@@ -0,0 +1,15 @@
+// HTTP frontline / lib/log
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//go:build windows || plan9
+// +build windows plan9
+
+package log
+
+import (
+    "fmt"
+)
+
+func openSyslog(tag string) (writer, error) {
+    return nil, fmt.Errorf("syslog is not supported")
+}
@@ -0,0 +1,59 @@
+// HTTP frontline / lib/match
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package match
+
+import (
+    "fmt"
+    "net"
+    "path"
+    "strings"
+)
+
+// Pattern matches a destination hostport.
+// "*.example.com:443", "example.com" (any port), "*:22"
+type Pattern struct {
+    host string
+    port string
+}
+
+func Parse(s string) (*Pattern, error) {
+    if s == "" {
+	return nil, fmt.Errorf("empty pattern")
+    }
+    p := &Pattern{ host: s, port: "*" }
+    if h, port, err := net.SplitHostPort(s); err == nil {
+	p.host = h
+	p.port = port
+    }
+    p.host = strings.ToLower(p.host)
+    // check syntax
+    if _, err := path.Match(p.host, ""); err != nil {
+	return nil, fmt.Errorf("bad pattern %s: %v", s, err)
+    }
+    if _, err := path.Match(p.port, ""); err != nil {
+	return nil, fmt.Errorf("bad pattern %s: %v", s, err)
+    }
+    return p, nil
+}
+
+func (p *Pattern)Match(hostport string) bool {
+    host, port, err := net.SplitHostPort(hostport)
+    if err != nil {
+	host = hostport
+	port = ""
+    }
+    host = strings.ToLower(host)
+    if ok, _ := path.Match(p.port, port); !ok {
+	return false
+    }
+    ok, _ := path.Match(p.host, host)
+    return ok
+}
+
+func (p *Pattern)String() string {
+    if p.port == "*" {
+	return p.host
+    }
+    return net.JoinHostPort(p.host, p.port)
+}
@@ -6,29 +6,105 @@ package msg
 import (
     "fmt"
     "net"
+    "strings"
+    "sync"
+    "sync/atomic"
     "time"
 
     "frontline/lib/log"
+    "frontline/lib/ratelimit"
+    "frontline/lib/stats"
 )
 
+func init() {
+    stats.Help("connections_active", "Connections currently running.")
+    stats.Help("connections_total", "Connections started.")
+    stats.Help("connects_total", "Successful connects.")
+    stats.Help("connect_failures_total", "Failed connects by reason.")
+    stats.Help("connection_bytes_total", "Bytes read from (in) and written to (out) local sockets.")
+    stats.Help("window_stalls_total", "Times a connection waited for DataAck from the peer.")
+    stats.Help("inbound_overflows_total", "Connections canceled because the peer overran the inbound queue.")
+}
+
 const LocalBufferSize = 1024
 
+// Window is the number of DataCommands sent without DataAck, up to 256KB
+// with LocalBufferSize reads. A peer with CapWindow acks after writing the
+// data, so a slow local socket stops the sender instead of filling the
+// inbound queue. An old peer acks on receipt and blocks the link instead,
+// for queueHold at most.
+const Window = 256
+
+// queueHold is how long a full inbound queue may hold the link of an old
+// peer before the connection is canceled.
+const queueHold = time.Second
+
+// queueSize holds a full window of DataCommands and a window of DataAcks
+// for what this side sent, with room for control commands.
+const queueSize = Window * 2 + 16
+
 type Connection struct {
     Id int
-    Used bool
+    // guards state and the queues which are replaced on Open
+    mu sync.Mutex
+    state State
     Next *Connection
     Q chan Command
     SeqLocal, SeqRemote int
-    freeing bool
+    // DataCommands sent and not acknowledged yet
+    inflight int
+    // stops Run, true tells the peer with DisconnectCommand
     ctrl_q chan bool
+    // the tunnel was established
     connected bool
+    // the inbound queue overflowed, logged once
+    overflowed bool
+    // capabilities of the peer, shared with the ConnectionManager
+    caps *int32
+    // set with SetEarlyData under mu, sent after ConnectAck, local reads
+    // wait until then
+    early []byte
+    waitAck bool
+    // set with Configure under mu
+    Priority int
+    Rate *ratelimit.Set
+    // answers the local client on ConnectAck, HTTP CONNECT if nil
+    Reply func(ok bool, reason string) []byte
+    // for monitoring
+    HostPort string
+    Remote string
+    // address the peer connected to, from ConnectAck
+    PeerAddr string
+    // code of a failed ConnectAck
+    Reason string
+    Start time.Time
+    // when the tunnel stopped
+    End time.Time
+    bytesIn, bytesOut int64
 }
 
-func localReader(id int, hostport string, conn net.Conn, buf []byte, q_lread chan<- int, q_lwait <-chan bool, running *bool) {
-    tag := log.NewTag(fmt.Sprintf("C[%d] localReader <%s>", id, hostport))
-    tag.Printf("start")
+// ConnectionInfo is a snapshot of a running connection.
+type ConnectionInfo struct {
+    Id int `json:"id"`
+    State string `json:"state"`
+    HostPort string `json:"hostport"`
+    Remote string `json:"remote"`
+    PeerAddr string `json:"peer_addr,omitempty"`
+    Reason string `json:"reason,omitempty"`
+    Start time.Time `json:"start"`
+    Age string `json:"age"`
+    BytesIn int64 `json:"bytes_in"`
+    BytesOut int64 `json:"bytes_out"`
+    SeqLocal int `json:"seq_local"`
+    SeqRemote int `json:"seq_remote"`
+    Rate float64 `json:"rate"`
+}
+
+func localReader(id int, hostport string, conn net.Conn, buf []byte, q_lread chan<- int, q_lwait <-chan bool, running *int32) {
+    tag := log.NewTag("conn", "conn", id, "hostport", hostport)
+    tag.Debugf("reader start")
     var bytes uint64 = 0
-    for *running {
+    for atomic.LoadInt32(running) != 0 {
 	now := time.Now()
 	conn.SetReadDeadline(now.Add(time.Second))
 	r, err := conn.Read(buf)
@@ -38,11 +114,11 @@ func localReader(id int, hostport string, conn net.Conn, buf []byte, q_lread cha
 		    continue
 		}
 	    }
-	    tag.Printf("Read: %v\n", err)
+	    tag.Debugf("Read: %v", err)
 	    break
 	}
 	if r == 0 {
-	    tag.Printf("closed\n")
+	    tag.Debugf("closed")
 	    break
 	}
 	bytes += uint64(r)
@@ -60,19 +136,51 @@ func localReader(id int, hostport string, conn net.Conn, buf []byte, q_lread cha
     q_lread <- 0
     <-q_lwait
     close(q_lread)
-    tag.Printf("end (recv %d bytes)\n", bytes)
+    tag.With("recv", bytes).Debugf("reader end")
+}
+
+// HTTPReply is the response to a CONNECT client for a ConnectAck.
+func HTTPReply(ok bool, reason string) []byte {
+    if ok {
+	return []byte("HTTP/1.0 200 Established\r\n\r\n")
+    }
+    switch reason {
+    case "quota":
+	return []byte("HTTP/1.0 429 Too Many Requests\r\n\r\n")
+    case "denied":
+	return []byte("HTTP/1.0 403 Forbidden\r\n\r\n")
+    case "dial":
+	return []byte("HTTP/1.0 502 Bad Gateway\r\n\r\n")
+    }
+    return []byte("HTTP/1.0 400 Bad Request\r\n\r\n")
 }
 
 func (c *Connection)Run(hostport string, conn net.Conn, q_req chan<- []byte) {
     id := c.Id
-    tag := log.NewTag(fmt.Sprintf("C[%d]", id))
-    tag.Printf("start - %s", hostport)
+    tag := log.NewTag("conn", "conn", id, "hostport", hostport)
+    tag.Debugf("start")
+    c.mu.Lock()
+    c.HostPort = hostport
+    c.Remote = fmt.Sprintf("%v", conn.RemoteAddr())
+    c.Start = time.Now()
+    reply := c.Reply
+    early, waitAck := c.early, c.waitAck
+    c.mu.Unlock()
+    stats.Counter("connections_total").Inc()
+    active := stats.Gauge("connections_active")
+    active.Inc()
+    defer active.Dec()
+    bytesIn := stats.Counter("connection_bytes_total", "direction", "in")
+    bytesOut := stats.Counter("connection_bytes_total", "direction", "out")
+    if reply == nil {
+	reply = HTTPReply
+    }
 
     buf := make([]byte, LocalBufferSize)
     q_lread := make(chan int, 32)
     q_lwait := make(chan bool, 32)
     // start LocalReader
-    running := true
+    running := int32(1)
     go localReader(id, hostport, conn, buf, q_lread, q_lwait, &running)
     localwaiter := func() {
 	for {
@@ -87,122 +195,322 @@ func (c *Connection)Run(hostport string, conn net.Conn, q_req chan<- []byte) {
 	    }
 	}
     }
+    // closed when the reader is done with q_lwait
+    waited := make(chan bool)
     stop := func() {
-	running = false
-	go localwaiter()
+	atomic.StoreInt32(&running, 0)
+	go func() {
+	    localwaiter()
+	    close(waited)
+	}()
+    }
+    // each side sends CloseWrite when its local socket is done, the first
+    // one moves to HalfClosed and the second one ends Run
+    localDone, remoteDone := false, false
+    closeWrite := func() bool {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+	    return cw.CloseWrite() == nil
+	}
+	return false
     }
+    sendData := func(data []byte) {
+	c.Rate.Wait(len(data))
+	bytesIn.Add(int64(len(data)))
+	atomic.AddInt64(&c.bytesIn, int64(len(data)))
+	c.mu.Lock()
+	seq := c.SeqLocal
+	c.SeqLocal = (seq + 1) & 0xff
+	c.mu.Unlock()
+	datacmd := PackedDataCommand(id, seq, data)
+	c.inflight++
+	q_req <- datacmd
+    }
+    stalls := stats.Counter("window_stalls_total")
+    stalled := false
     lastrecv := time.Now()
-    for running {
+    for atomic.LoadInt32(&running) != 0 {
+	// hold local reads until the connect is acked or the window opens
+	lread := q_lread
+	if waitAck && !c.connected || localDone {
+	    lread = nil
+	} else if c.inflight >= Window {
+	    lread = nil
+	    if !stalled {
+		stalls.Inc()
+	    }
+	    stalled = true
+	} else {
+	    stalled = false
+	}
 	select {
 	case cmd := <-c.Q:
 	    switch cmd := cmd.(type) {
 	    case *ConnectAckCommand:
-		if c.connected {
+		if c.State() != Connecting {
 		    // ignore
 		    break
 		}
 		if !cmd.Ok {
-		    conn.Write([]byte("HTTP/1.0 400 Bad Request\r\n\r\n"))
+		    reason := "rejected"
+		    if i := strings.Index(cmd.Reason, ":"); i > 0 {
+			reason = cmd.Reason[:i]
+		    }
+		    c.mu.Lock()
+		    c.Reason = reason
+		    c.mu.Unlock()
+		    stats.Counter("connect_failures_total", "reason", reason).Inc()
+		    tag.With("reason", cmd.Reason).Warnf("rejected by peer")
+		    conn.Write(reply(false, reason))
 		    stop()
 		    break
 		}
-		conn.Write([]byte("HTTP/1.0 200 Established\r\n\r\n"))
-		c.connected = true
+		if err := c.Transition(Established); err != nil {
+		    stop()
+		    break
+		}
+		conn.Write(reply(true, ""))
+		stats.Counter("connects_total").Inc()
+		c.mu.Lock()
+		c.PeerAddr = cmd.Addr
+		c.mu.Unlock()
+		tag.With("addr", cmd.Addr).Printf("connected")
+		if len(early) > 0 {
+		    sendData(early)
+		    early = nil
+		}
 	    case *DataCommand:
 		// write to local connection
 		seq := cmd.Seq
 		if seq != c.SeqRemote {
-		    tag.Printf("invalid seq %d\n", seq)
+		    tag.Warnf("invalid seq %d", seq)
 		}
-		dataackcmd := PackedDataAckCommand(cmd)
-		q_req <- dataackcmd
-		c.SeqRemote++
+		c.mu.Lock()
+		c.SeqRemote = (c.SeqRemote + 1) & 0xff
+		c.mu.Unlock()
 		if len(cmd.Data) > 0 {
+		    c.Rate.Wait(len(cmd.Data))
 		    conn.Write(cmd.Data)
+		    bytesOut.Add(int64(len(cmd.Data)))
+		    atomic.AddInt64(&c.bytesOut, int64(len(cmd.Data)))
 		}
+		// ack when written, it opens the window of the peer
+		q_req <- PackedDataAckCommand(cmd)
 	    case *DataAckCommand:
-		// TODO: ACK
+		if c.inflight > 0 {
+		    c.inflight--
+		}
 	    case *DisconnectCommand:
-		// disconnect from remote
-		stop()
+		if !cmd.Write || localDone {
+		    // disconnect from remote or both sides are done
+		    stop()
+		    break
+		}
+		if c.State() != Established || !closeWrite() {
+		    q_req <- PackedDisconnectCommand(id)
+		    stop()
+		    break
+		}
+		tag.Debugf("remote closed")
+		c.Transition(HalfClosed)
+		remoteDone = true
 	    }
 	    lastrecv = time.Now()
-	case r:= <-q_lread:
+	case r:= <-lread:
 	    if r > 0 {
 		// DataCommand
-		datacmd := PackedDataCommand(id, c.SeqLocal, buf[:r])
-		c.SeqLocal++
-		q_req <- datacmd
+		sendData(buf[:r])
 	    } else {
-		tag.Printf("local closed\n")
-		// DisconnectCommand
-		q_req <- PackedDisconnectCommand(id)
-		running = false
+		tag.Debugf("local closed")
+		if !remoteDone && c.peerCaps() & CapHalfClose != 0 && c.State() == Established {
+		    // the peer keeps sending until its side is done
+		    q_req <- PackedCloseWriteCommand(id)
+		    c.Transition(HalfClosed)
+		    localDone = true
+		} else {
+		    // DisconnectCommand
+		    q_req <- PackedDisconnectCommand(id)
+		    atomic.StoreInt32(&running, 0)
+		    close(waited)
+		}
 	    }
 	    q_lwait <- true
 	case <-time.After(time.Minute):
-	    tag.Printf("check - %s", hostport)
+	    tag.Debugf("check")
 	    // disconnect no data in 1hour
 	    if time.Now().After(lastrecv.Add(time.Hour)) {
-		tag.Printf("no data in 1 hour\n")
+		tag.Printf("no data in 1 hour")
 		stop()
 	    }
-	case <-c.ctrl_q:
-	    // cancel
+	case notify := <-c.ctrl_q:
+	    // cancel, the peer frees the id only when told
+	    if notify {
+		q_req <- PackedDisconnectCommand(id)
+	    }
 	    stop()
 	}
     }
+    c.mu.Lock()
+    c.End = time.Now()
+    c.setState(Closing)
+    c.mu.Unlock()
 
     time.Sleep(time.Second * 3)
+    <-waited
     close(q_lwait)
 
-    tag.Printf("end - %s", hostport)
+    tag.With("in", atomic.LoadInt64(&c.bytesIn), "out", atomic.LoadInt64(&c.bytesOut)).Debugf("end")
 }
 
 func (c *Connection)Init(id int) {
     c.Id = id
-    c.Used = false
+    c.state = Idle
     c.Next = nil
-    c.Q = make(chan Command, 32)
+    c.Q = make(chan Command, queueSize)
     c.SeqLocal = 0
     c.SeqRemote = 0
-    c.ctrl_q = make(chan bool)
+    c.inflight = 0
+    c.ctrl_q = make(chan bool, 1)
     c.connected = false
-    c.freeing = false
+    c.Priority = 1
 }
 
-func (c *Connection)Cancel() {
-    if c.Used {
-	if !c.freeing {
-	    c.ctrl_q <- true
-	}
+// peerCaps returns the capabilities of the peer of the link.
+func (c *Connection)peerCaps() int {
+    if c.caps == nil {
+	return 0
     }
+    return int(atomic.LoadInt32(c.caps))
+}
+
+// Configure sets the rate limit, the scheduling weight and the answer to
+// the local client of a connection opened for Run, reply nil answers HTTP
+// CONNECT. The admin API and the scheduler read them meanwhile.
+func (c *Connection)Configure(rate *ratelimit.Set, priority int, reply func(ok bool, reason string) []byte) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.Rate = rate
+    c.Priority = priority
+    c.Reply = reply
 }
 
-func (c *Connection)FlushQ() {
+// SetEarlyData gives data already read from the local socket, like bytes
+// pipelined after the CONNECT header or TCP Fast Open data. Run sends it
+// first once the peer acknowledges the connect and holds local reads until
+// then.
+func (c *Connection)SetEarlyData(data []byte) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.early = data
+    c.waitAck = true
+}
+
+// Cancel asks Run to stop and to tell the peer. It does not wait, a
+// connection which is still dialing picks it up when Run starts. It
+// returns false when the connection is already ending or idle.
+func (c *Connection)Cancel() bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.cancel(true)
+}
+
+// cancel is Cancel with c.mu held, notify false stops Run without telling
+// the peer when the link is gone.
+func (c *Connection)cancel(notify bool) bool {
+    if !c.state.running() {
+	return false
+    }
+    select {
+    case c.ctrl_q <- notify:
+    default:
+    }
+    return true
+}
+
+// flushQ replaces the queues, c.mu must be held.
+func (c *Connection)flushQ() {
     close(c.Q)
-    c.Q = make(chan Command, 32)
+    c.Q = make(chan Command, queueSize)
     close(c.ctrl_q)
-    c.ctrl_q = make(chan bool)
+    c.ctrl_q = make(chan bool, 1)
     // TODO: move it
     c.SeqLocal = 0
     c.SeqRemote = 0
+    c.inflight = 0
+    c.connected = false
+    c.overflowed = false
+    c.early = nil
+    c.waitAck = false
+    c.Priority = 1
+    c.Rate = nil
+    c.Reply = nil
+    c.HostPort = ""
+    c.Remote = ""
+    c.PeerAddr = ""
+    c.Reason = ""
+    c.Start = time.Time{}
+    c.End = time.Time{}
+    atomic.StoreInt64(&c.bytesIn, 0)
+    atomic.StoreInt64(&c.bytesOut, 0)
+}
+
+// Info returns a snapshot of c.
+func (c *Connection)Info() ConnectionInfo {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.info()
+}
+
+// info is Info with c.mu held.
+func (c *Connection)info() ConnectionInfo {
+    return ConnectionInfo{
+	Id: c.Id,
+	State: c.state.String(),
+	HostPort: c.HostPort,
+	Remote: c.Remote,
+	PeerAddr: c.PeerAddr,
+	Reason: c.Reason,
+	Start: c.Start,
+	Age: time.Since(c.Start).Round(time.Second).String(),
+	BytesIn: atomic.LoadInt64(&c.bytesIn),
+	BytesOut: atomic.LoadInt64(&c.bytesOut),
+	SeqLocal: c.SeqLocal,
+	SeqRemote: c.SeqRemote,
+	Rate: c.Rate.Rate(),
+    }
+}
+
+// Bytes returns the bytes read from and written to the local socket.
+func (c *Connection)Bytes() (int64, int64) {
+    return atomic.LoadInt64(&c.bytesIn), atomic.LoadInt64(&c.bytesOut)
+}
+
+// Connected reports whether the peer acknowledged the connect.
+func (c *Connection)Connected() bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.connected
 }
 
+// Free keeps a closing connection in cooldown for a minute, then it is idle
+// again and done is called.
 func (c *Connection)Free(done func()) {
-    c.freeing = true
+    if err := c.Transition(Cooldown); err != nil {
+	return
+    }
     go func() {
 	time.Sleep(time.Minute)
-	c.Used = false
-	c.connected = false
+	c.Transition(Idle)
 	done()
-	c.freeing = false
     }()
 }
 
 type ConnectionManager struct {
     connections []Connection
+    // guards the free list
+    mu sync.Mutex
     free *Connection
+    // capabilities of the peer, set with SetPeerCaps
+    caps int32
 }
 
 func NewConnectionManager() *ConnectionManager {
@@ -212,6 +520,7 @@ func NewConnectionManager() *ConnectionManager {
     for i := 0; i < 256; i++ {
 	c := &cm.connections[i]
 	c.Init(i)
+	c.caps = &cm.caps
 	c.Next = prev
 	prev = c
     }
@@ -219,19 +528,57 @@ func NewConnectionManager() *ConnectionManager {
     return cm
 }
 
+// SetPeerCaps tells how Queue treats a full inbound queue and how Run ends
+// a connection, it is called with the capabilities of each new link.
+func (cm *ConnectionManager)SetPeerCaps(caps int) {
+    atomic.StoreInt32(&cm.caps, int32(caps))
+}
+
 func (cm *ConnectionManager)Queue(cmd Command) {
     connId := cmd.Id()
     if connId < 0 || connId >= 256 {
 	return
     }
     c := &cm.connections[connId]
-    if !c.Used {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if !c.state.running() {
 	return
     }
-    c.Q <- cmd
+    q := c.Q
+    deadline := time.Now().Add(queueHold)
+    for {
+	select {
+	case q <- cmd:
+	    return
+	default:
+	}
+	if atomic.LoadInt32(&cm.caps) & CapWindow != 0 || time.Now().After(deadline) {
+	    break
+	}
+	// an old peer does not keep to the window, hold the link as it
+	// expects until Run takes the command or stops, a connection which
+	// stays behind is canceled as below to let the others go on
+	c.mu.Unlock()
+	time.Sleep(time.Millisecond * 10)
+	c.mu.Lock()
+	if !c.state.running() || c.Q != q {
+	    return
+	}
+    }
+    // never block the link for long, a peer overrunning the queue loses
+    // the connection and is told so that it frees the id
+    if !c.overflowed {
+	c.overflowed = true
+	stats.Counter("inbound_overflows_total").Inc()
+	log.NewTag("conn", "conn", connId).Warnf("inbound queue full, cancel")
+	c.cancel(true)
+    }
 }
 
 func (cm *ConnectionManager)GetFree() *Connection {
+    cm.mu.Lock()
+    defer cm.mu.Unlock()
     c := cm.free
     if c != nil {
 	cm.free = c.Next
@@ -246,24 +593,70 @@ func (cm *ConnectionManager)Get(i int) *Connection {
     return &cm.connections[i]
 }
 
+// Priority returns the scheduling weight of the connection.
+func (cm *ConnectionManager)Priority(i int) int {
+    c := cm.Get(i)
+    if c == nil {
+	return 1
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.Priority
+}
+
 func (cm *ConnectionManager)PutFree(c *Connection) {
+    cm.mu.Lock()
+    defer cm.mu.Unlock()
     c.Next = cm.free
     cm.free = c
 }
 
+// ActiveCount returns the number of running connections.
+func (cm *ConnectionManager)ActiveCount() int {
+    return len(cm.Active())
+}
+
+// FreeCount returns the number of unused connection slots.
+func (cm *ConnectionManager)FreeCount() int {
+    n := 0
+    for i := 0; i < 256; i++ {
+	if cm.connections[i].State() == Idle {
+	    n++
+	}
+    }
+    return n
+}
+
+// Active returns snapshots of the running connections.
+func (cm *ConnectionManager)Active() []ConnectionInfo {
+    list := []ConnectionInfo{}
+    for i := 0; i < 256; i++ {
+	c := &cm.connections[i]
+	c.mu.Lock()
+	if c.state.running() && !c.Start.IsZero() {
+	    list = append(list, c.info())
+	}
+	c.mu.Unlock()
+    }
+    return list
+}
+
 func (cm *ConnectionManager)Connections() []Connection {
     return cm.connections
 }
 
 func (cm *ConnectionManager)Clean() {
+    // the link is gone, nobody sends a DisconnectCommand
     for i := 0; i < 256; i++ {
 	c := &cm.connections[i]
-	c.Cancel()
+	c.mu.Lock()
+	c.cancel(false)
+	c.mu.Unlock()
     }
 
     for i := 0; i < 256; i++ {
 	c := &cm.connections[i]
-	for c.Used {
+	for c.State() != Idle {
 	    time.Sleep(time.Second)
 	}
     }
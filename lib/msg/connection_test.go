@@ -0,0 +1,165 @@
+// HTTP frontline / lib/msg
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package msg
+
+import (
+    "bytes"
+    "net"
+    "testing"
+    "time"
+)
+
+// openConnection takes a free connection of cm.
+func openConnection(t *testing.T, cm *ConnectionManager) *Connection {
+    c := cm.GetFree()
+    if err := c.Open(); err != nil {
+	t.Fatalf("Open: %v", err)
+    }
+    return c
+}
+
+// runConnection starts Run on c with a pipe as the local socket.
+func runConnection(t *testing.T, c *Connection) chan []byte {
+    local, remote := net.Pipe()
+    t.Cleanup(func() {
+	local.Close()
+	remote.Close()
+    })
+    q_req := make(chan []byte, 16)
+    go c.Run("example.com:443", local, q_req)
+    for c.Info().Start.IsZero() {
+	time.Sleep(time.Millisecond)
+    }
+    return q_req
+}
+
+// expectDisconnect waits for the DisconnectCommand of c on q_req.
+func expectDisconnect(t *testing.T, c *Connection, q_req chan []byte) {
+    want := PackedDisconnectCommand(c.Id)
+    timeout := time.After(time.Second * 2)
+    for {
+	select {
+	case cmd := <-q_req:
+	    if bytes.Equal(cmd, want) {
+		return
+	    }
+	case <-timeout:
+	    t.Fatalf("no Disconnect for %d", c.Id)
+	}
+    }
+}
+
+func TestCancelDisconnects(t *testing.T) {
+    cm := NewConnectionManager()
+    c := openConnection(t, cm)
+    q_req := runConnection(t, c)
+    if !c.Cancel() {
+	t.Fatalf("running connection not canceled")
+    }
+    expectDisconnect(t, c, q_req)
+    for c.State() != Closing {
+	time.Sleep(time.Millisecond)
+    }
+    // nothing left to cancel
+    if c.Cancel() {
+	t.Errorf("canceled in %s", c.State())
+    }
+}
+
+func TestCancelWithoutNotify(t *testing.T) {
+    cm := NewConnectionManager()
+    c := openConnection(t, cm)
+    q_req := runConnection(t, c)
+    // as Clean does when the link is gone
+    c.mu.Lock()
+    c.cancel(false)
+    c.mu.Unlock()
+    for c.State() != Closing {
+	time.Sleep(time.Millisecond)
+    }
+    select {
+    case cmd := <-q_req:
+	t.Errorf("got %v", cmd)
+    default:
+    }
+}
+
+func TestOverflowDisconnects(t *testing.T) {
+    cm := NewConnectionManager()
+    cm.SetPeerCaps(CapWindow)
+    c := openConnection(t, cm)
+    // a peer ignoring the window fills the queue before Run takes any
+    for i := 0; i <= queueSize; i++ {
+	cm.Queue(&DataAckCommand{ ConnId: c.Id, DataLen: 1 })
+    }
+    q_req := runConnection(t, c)
+    expectDisconnect(t, c, q_req)
+}
+
+func TestEarlyDataAfterAck(t *testing.T) {
+    cm := NewConnectionManager()
+    c := openConnection(t, cm)
+    c.SetEarlyData([]byte("hello"))
+    local, remote := net.Pipe()
+    t.Cleanup(func() {
+	local.Close()
+	remote.Close()
+    })
+    replies := make(chan []byte, 1)
+    go func() {
+	buf := make([]byte, 256)
+	n, _ := remote.Read(buf)
+	replies <- buf[:n]
+    }()
+    q_req := make(chan []byte, 16)
+    go c.Run("example.com:443", local, q_req)
+    // the client goes on before the answer, it waits behind the early data
+    go remote.Write([]byte("world"))
+    select {
+    case cmd := <-q_req:
+	t.Fatalf("sent %v before ConnectAck", cmd)
+    case <-time.After(time.Millisecond * 200):
+    }
+    cm.Queue(&ConnectAckCommand{ ConnId: c.Id, Ok: true })
+    if got := string(<-replies); got != string(HTTPReply(true, "")) {
+	t.Errorf("reply %q", got)
+    }
+    for _, want := range []string{ "hello", "world" } {
+	select {
+	case buf := <-q_req:
+	    cmd, _ := ParseCommand(buf)
+	    data, ok := cmd.(*DataCommand)
+	    if !ok || string(data.Data) != want {
+		t.Fatalf("got %#v, want %q", cmd, want)
+	    }
+	case <-time.After(time.Second * 2):
+	    t.Fatalf("no data %q", want)
+	}
+    }
+}
+
+func TestOverflowHoldsOldPeer(t *testing.T) {
+    cm := NewConnectionManager()
+    c := openConnection(t, cm)
+    for i := 0; i < queueSize; i++ {
+	cm.Queue(&DataAckCommand{ ConnId: c.Id, DataLen: 1 })
+    }
+    // a peer without the window waits for Run, but not forever
+    start := time.Now()
+    done := make(chan bool)
+    go func() {
+	cm.Queue(&DataAckCommand{ ConnId: c.Id, DataLen: 1 })
+	close(done)
+    }()
+    select {
+    case <-done:
+	if d := time.Since(start); d < queueHold {
+	    t.Errorf("held for %v", d)
+	}
+    case <-time.After(queueHold * 3):
+	t.Fatalf("link held over %v", queueHold * 3)
+    }
+    q_req := runConnection(t, c)
+    expectDisconnect(t, c, q_req)
+}
@@ -4,6 +4,9 @@
 package msg
 
 import (
+    "fmt"
+    "strconv"
+    "strings"
     "time"
 )
 
@@ -15,15 +18,42 @@ const (
     disconnectCommand
     dataCommand
     dataAckCommand
+    keepaliveAckCommand
+    goawayCommand
+    connectAckExCommand
+    connectExCommand
+    closeWriteCommand
 )
 
+// Capabilities advertised in LinkCommand. A peer drops the link on a
+// command it does not know, so commands added later are only sent to a
+// peer which has the bit.
+const (
+    CapKeepaliveAck = 1 << iota
+    CapGoaway
+    CapConnectAckAddr
+    CapConnectUser
+    // DataAck after the local write and at most Window DataCommands unacked
+    CapWindow
+    CapHalfClose
+)
+
+// Caps is what this side supports.
+const Caps = CapKeepaliveAck | CapGoaway | CapConnectAckAddr | CapConnectUser | CapWindow | CapHalfClose
+
+// capsSep can not appear in a host name, an old peer sees it as part of
+// the client name.
+const capsSep = " caps="
+
 type Command interface {
     Name() string
     Id() int
 }
 
+// PackedLinkCommand sends the name of the client and Caps.
 func PackedLinkCommand(client string) []byte {
     err := []byte{}
+    client += capsSep + fmt.Sprintf("%x", Caps)
     clen := len(client)
     if clen >= 128 {
 	return err
@@ -40,6 +70,8 @@ func PackedLinkCommand(client string) []byte {
 
 type LinkCommand struct {
     Client string
+    // capabilities of the peer, 0 for an old one
+    Caps int
 }
 
 func ParseLinkCommand(buf []byte) (*LinkCommand, int) {
@@ -56,6 +88,12 @@ func ParseLinkCommand(buf []byte) (*LinkCommand, int) {
     for i := 0; i < clen; i++ {
 	c.Client += string(buf[i + 2] ^ 0xaa)
     }
+    if i := strings.LastIndex(c.Client, capsSep); i >= 0 {
+	caps, err := strconv.ParseInt(c.Client[i + len(capsSep):], 16, 32)
+	if err == nil {
+	    c.Client, c.Caps = c.Client[:i], int(caps)
+	}
+    }
     return c, ptr
 }
 
@@ -68,7 +106,11 @@ func (c *LinkCommand)Id() int {
 }
 
 func PackedKeepaliveCommand() []byte {
-    t, _ := time.Now().MarshalBinary()
+    return PackedKeepaliveCommandAt(time.Now())
+}
+
+func PackedKeepaliveCommandAt(now time.Time) []byte {
+    t, _ := now.MarshalBinary()
     buf := make([]byte, 2 + len(t))
     buf[0] = keepaliveCommand
     buf[1] = byte(len(t))
@@ -81,11 +123,17 @@ type KeepaliveCommand struct {
 }
 
 func ParseKeepaliveCommand(buf []byte) (*KeepaliveCommand, int) {
+    if len(buf) < 2 {
+	return nil, 0
+    }
     l := int(buf[1])
+    if len(buf) < 2 + l {
+	return nil, 0
+    }
     c := &KeepaliveCommand{}
     c.T = time.Time{}
     t := &c.T
-    t.UnmarshalBinary(buf[2:])
+    t.UnmarshalBinary(buf[2:2 + l])
     return c, 2 + l
 }
 
@@ -97,6 +145,38 @@ func (c *KeepaliveCommand)Id() int {
     return -1
 }
 
+// PackedKeepaliveAckCommand echoes the timestamp of the keepalive back.
+func PackedKeepaliveAckCommand(cmd *KeepaliveCommand) []byte {
+    t, _ := cmd.T.MarshalBinary()
+    buf := make([]byte, 2 + len(t))
+    buf[0] = keepaliveAckCommand
+    buf[1] = byte(len(t))
+    copy(buf[2:], t)
+    return buf
+}
+
+type KeepaliveAckCommand struct {
+    T time.Time
+}
+
+func ParseKeepaliveAckCommand(buf []byte) (*KeepaliveAckCommand, int) {
+    k, clen := ParseKeepaliveCommand(buf)
+    if k == nil {
+	return nil, clen
+    }
+    return &KeepaliveAckCommand{ T: k.T }, clen
+}
+
+func (c *KeepaliveAckCommand)Name() string {
+    return "KeepaliveAckCommand"
+}
+
+func (c *KeepaliveAckCommand)Id() int {
+    return -1
+}
+
+// PackedConnectCommand asks for hostport, user is the proxy user on
+// backline or empty.
 func PackedConnectCommand(connId int, hostport string) []byte {
     err := []byte{}
     if connId >= 256 {
@@ -117,9 +197,32 @@ func PackedConnectCommand(connId int, hostport string) []byte {
     return buf
 }
 
+// PackedConnectExCommand adds the proxy user for a peer with
+// CapConnectUser.
+func PackedConnectExCommand(connId int, hostport, user string) []byte {
+    err := []byte{}
+    ulen := len(user)
+    if ulen >= 128 {
+	return err
+    }
+    buf := PackedConnectCommand(connId, hostport)
+    if len(buf) == 0 {
+	return err
+    }
+    buf[0] = connectExCommand
+    buf = append(buf, byte(ulen))
+    // mask with 0xaa
+    for _, b := range []byte(user) {
+	buf = append(buf, b ^ 0xaa)
+    }
+    return buf
+}
+
 type ConnectCommand struct {
     ConnId int
     HostPort string
+    // from ConnectEx, empty in the short Connect
+    User string
 }
 
 func ParseConnectCommand(buf []byte) (*ConnectCommand, int) {
@@ -141,6 +244,21 @@ func ParseConnectCommand(buf []byte) (*ConnectCommand, int) {
     return c, ptr
 }
 
+func ParseConnectExCommand(buf []byte) (*ConnectCommand, int) {
+    c, ptr := ParseConnectCommand(buf)
+    if c == nil || len(buf) < ptr + 1 {
+	return nil, 0
+    }
+    ulen := int(buf[ptr])
+    if len(buf) < ptr + 1 + ulen {
+	return nil, 0
+    }
+    for i := 0; i < ulen; i++ {
+	c.User += string(buf[ptr + 1 + i] ^ 0xaa)
+    }
+    return c, ptr + 1 + ulen
+}
+
 func (c *ConnectCommand)Name() string {
     return "ConnectCommand"
 }
@@ -161,9 +279,36 @@ func PackedConnectAckCommand(cmd *ConnectCommand, ok bool) []byte {
     return buf
 }
 
+// PackedConnectAckExCommand answers cmd with the address connected to or
+// the reason of a failure, "code: detail", for a peer with
+// CapConnectAckAddr.
+func PackedConnectAckExCommand(cmd *ConnectCommand, ok bool, addr string) []byte {
+    if len(addr) >= 128 {
+	addr = addr[:127]
+    }
+    alen := len(addr)
+    buf := make([]byte, 4 + alen)
+    buf[0] = connectAckExCommand
+    buf[1] = byte(cmd.ConnId)
+    if ok {
+	buf[2] = 1
+    } else {
+	buf[2] = 0
+    }
+    buf[3] = byte(alen)
+    // mask with 0xaa
+    for i, b := range []byte(addr) {
+	buf[i + 4] = b ^ 0xaa
+    }
+    return buf
+}
+
 type ConnectAckCommand struct {
     ConnId int
     Ok bool
+    // from ConnectAckEx, empty in the short ConnectAck
+    Addr string
+    Reason string
 }
 
 func ParseConnectAckCommand(buf []byte) (*ConnectAckCommand, int) {
@@ -181,6 +326,28 @@ func ParseConnectAckCommand(buf []byte) (*ConnectAckCommand, int) {
     return c, 3
 }
 
+func ParseConnectAckExCommand(buf []byte) (*ConnectAckCommand, int) {
+    if len(buf) < 4 {
+	return nil, 0
+    }
+    alen := int(buf[3])
+    ptr := 4 + alen
+    if len(buf) < ptr {
+	return nil, 0
+    }
+    c, _ := ParseConnectAckCommand(buf)
+    s := ""
+    for i := 0; i < alen; i++ {
+	s += string(buf[i + 4] ^ 0xaa)
+    }
+    if c.Ok {
+	c.Addr = s
+    } else {
+	c.Reason = s
+    }
+    return c, ptr
+}
+
 func (c *ConnectAckCommand)Name() string {
     return "ConnectAckCommand"
 }
@@ -200,8 +367,23 @@ func PackedDisconnectCommand(connId int) []byte {
     return buf
 }
 
+// PackedCloseWriteCommand tells a peer with CapHalfClose that no more data
+// comes for connId, it still sends until its side is done.
+func PackedCloseWriteCommand(connId int) []byte {
+    err := []byte{}
+    if connId >= 256 {
+	return err
+    }
+    buf := make([]byte, 2)
+    buf[0] = closeWriteCommand
+    buf[1] = byte(connId)
+    return buf
+}
+
 type DisconnectCommand struct {
     ConnId int
+    // from CloseWrite, only the peer's side is done
+    Write bool
 }
 
 func ParseDisconnectCommand(buf []byte) (*DisconnectCommand, int) {
@@ -212,6 +394,14 @@ func ParseDisconnectCommand(buf []byte) (*DisconnectCommand, int) {
     return &DisconnectCommand{ ConnId: connId }, 2
 }
 
+func ParseCloseWriteCommand(buf []byte) (*DisconnectCommand, int) {
+    c, n := ParseDisconnectCommand(buf)
+    if c != nil {
+	c.Write = true
+    }
+    return c, n
+}
+
 func (c *DisconnectCommand)Name() string {
     return "DisconnectCommand"
 }
@@ -323,6 +513,27 @@ func (c *DataAckCommand)Id() int {
     return c.ConnId
 }
 
+// PackedGoawayCommand tells the peer that the supply line is closed on
+// purpose soon.
+func PackedGoawayCommand() []byte {
+    return []byte{ goawayCommand }
+}
+
+type GoawayCommand struct {
+}
+
+func ParseGoawayCommand(buf []byte) (*GoawayCommand, int) {
+    return &GoawayCommand{}, 1
+}
+
+func (c *GoawayCommand)Name() string {
+    return "GoawayCommand"
+}
+
+func (c *GoawayCommand)Id() int {
+    return -1
+}
+
 type UnknownCommand struct {
 }
 
@@ -343,6 +554,11 @@ func ParseCommand(buf []byte) (Command, int) {
     case disconnectCommand: return ParseDisconnectCommand(buf)
     case dataCommand: return ParseDataCommand(buf)
     case dataAckCommand: return ParseDataAckCommand(buf)
+    case keepaliveAckCommand: return ParseKeepaliveAckCommand(buf)
+    case goawayCommand: return ParseGoawayCommand(buf)
+    case connectAckExCommand: return ParseConnectAckExCommand(buf)
+    case connectExCommand: return ParseConnectExCommand(buf)
+    case closeWriteCommand: return ParseCloseWriteCommand(buf)
     }
     return &UnknownCommand{}, -1
 }
@@ -355,6 +571,7 @@ type CommandHandler interface {
     HandleDisconnect(cmd *DisconnectCommand)
     HandleData(cmd *DataCommand)
     HandleDataAck(cmd *DataAckCommand)
+    HandleGoaway(cmd *GoawayCommand)
 }
 
 func HandleCommand(h CommandHandler, cmd Command) {
@@ -366,5 +583,31 @@ func HandleCommand(h CommandHandler, cmd Command) {
     case *DisconnectCommand: h.HandleDisconnect(cmd)
     case *DataCommand: h.HandleData(cmd)
     case *DataAckCommand: h.HandleDataAck(cmd)
+    case *GoawayCommand: h.HandleGoaway(cmd)
+    }
+}
+
+// IsControlCommand reports whether the packed command is a link-level or
+// connection control command which should not wait behind bulk data.
+func IsControlCommand(buf []byte) bool {
+    if len(buf) == 0 {
+	return false
+    }
+    switch buf[0] {
+    case linkCommand, keepaliveCommand, keepaliveAckCommand, goawayCommand, connectCommand, connectAckCommand, connectAckExCommand, connectExCommand, disconnectCommand, closeWriteCommand:
+	return true
+    }
+    return false
+}
+
+// PackedCommandId returns the connection id of the packed command or -1.
+func PackedCommandId(buf []byte) int {
+    if len(buf) < 2 {
+	return -1
+    }
+    switch buf[0] {
+    case linkCommand, keepaliveCommand, keepaliveAckCommand, goawayCommand:
+	return -1
     }
+    return int(buf[1])
 }
@@ -0,0 +1,83 @@
+// HTTP frontline / lib/msg
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package msg
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+// oldLinkCommand is LinkCommand as a peer without capabilities sends it.
+func oldLinkCommand(client string) []byte {
+    buf := []byte{ linkCommand, byte(len(client)) }
+    for _, b := range []byte(client) {
+	buf = append(buf, b ^ 0xaa)
+    }
+    return buf
+}
+
+func TestParseCommand(t *testing.T) {
+    connect := &ConnectCommand{ ConnId: 7, HostPort: "example.com:443" }
+    keepalive := &KeepaliveCommand{ T: time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC) }
+    data := &DataCommand{ ConnId: 9, Seq: 255, Data: []byte("hello") }
+    tests := []struct {
+	name string
+	buf []byte
+	want Command
+    }{
+	{ "link", PackedLinkCommand("backline"), &LinkCommand{ Client: "backline", Caps: Caps } },
+	{ "old link", oldLinkCommand("backline"), &LinkCommand{ Client: "backline" } },
+	{ "keepalive", PackedKeepaliveCommandAt(keepalive.T), keepalive },
+	{ "keepalive ack", PackedKeepaliveAckCommand(keepalive), &KeepaliveAckCommand{ T: keepalive.T } },
+	{ "connect", PackedConnectCommand(7, "example.com:443"), connect },
+	{ "connect ex", PackedConnectExCommand(7, "[::1]:443", "alice"), &ConnectCommand{ ConnId: 7, HostPort: "[::1]:443", User: "alice" } },
+	{ "connect ex without user", PackedConnectExCommand(7, "example.com:443", ""), connect },
+	{ "connect ack", PackedConnectAckCommand(connect, true), &ConnectAckCommand{ ConnId: 7, Ok: true } },
+	{ "connect ack ex", PackedConnectAckExCommand(connect, true, "93.184.216.34:443"), &ConnectAckCommand{ ConnId: 7, Ok: true, Addr: "93.184.216.34:443" } },
+	{ "connect ack ex failure", PackedConnectAckExCommand(connect, false, "dial: refused"), &ConnectAckCommand{ ConnId: 7, Reason: "dial: refused" } },
+	{ "disconnect", PackedDisconnectCommand(7), &DisconnectCommand{ ConnId: 7 } },
+	{ "close write", PackedCloseWriteCommand(7), &DisconnectCommand{ ConnId: 7, Write: true } },
+	{ "data", PackedDataCommand(9, 255, data.Data), data },
+	{ "data ack", PackedDataAckCommand(data), &DataAckCommand{ ConnId: 9, Seq: 255, DataLen: 5 } },
+	{ "goaway", PackedGoawayCommand(), &GoawayCommand{} },
+    }
+    for _, tt := range tests {
+	cmd, n := ParseCommand(tt.buf)
+	if n != len(tt.buf) {
+	    t.Errorf("%s: parsed %d bytes of %d", tt.name, n, len(tt.buf))
+	    continue
+	}
+	if !reflect.DeepEqual(cmd, tt.want) {
+	    t.Errorf("%s: got %#v, want %#v", tt.name, cmd, tt.want)
+	}
+	// a command cut by the reader waits for the rest
+	if len(tt.buf) > 1 {
+	    if _, n := ParseCommand(tt.buf[:len(tt.buf) - 1]); n != 0 {
+		t.Errorf("%s: short buffer parsed %d bytes", tt.name, n)
+	    }
+	}
+    }
+}
+
+func TestParseUnknownCommand(t *testing.T) {
+    cmd, n := ParseCommand([]byte{ 0xff, 0 })
+    if _, ok := cmd.(*UnknownCommand); !ok || n >= 0 {
+	t.Errorf("got %#v %d", cmd, n)
+    }
+}
+
+func TestPackedCommandId(t *testing.T) {
+    if id := PackedCommandId(PackedDataCommand(9, 0, []byte("x"))); id != 9 {
+	t.Errorf("data: id %d", id)
+    }
+    if id := PackedCommandId(PackedCloseWriteCommand(7)); id != 7 {
+	t.Errorf("close write: id %d", id)
+    }
+    for _, buf := range [][]byte{ PackedLinkCommand("frontline"), PackedKeepaliveCommand(), PackedGoawayCommand() } {
+	if id := PackedCommandId(buf); id != -1 {
+	    t.Errorf("%d: id %d", buf[0], id)
+	}
+    }
+}
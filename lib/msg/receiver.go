@@ -9,15 +9,19 @@ import (
     "time"
 
     "frontline/lib/log"
+    "frontline/lib/stats"
 )
 
-func Receiver(conn net.Conn, q_recv chan<- Command, q_wait <-chan bool, running *bool) error {
+// Receiver parses commands into q_recv. It does not wait for them to be
+// handled, the handler must not block.
+func Receiver(conn net.Conn, q_recv chan<- Command, running *bool) error {
     defer close(q_recv)
-    tag := log.NewTag("Receiver")
+    tag := log.NewTag("receiver", "peer", "Unknown")
     if tcp, ok := conn.(*net.TCPConn); ok {
-	tag = log.NewTag(fmt.Sprintf("Receiver[%v]", tcp.RemoteAddr()))
+	tag = log.NewTag("receiver", "peer", fmt.Sprintf("%v", tcp.RemoteAddr()))
     }
 
+    rx := stats.Counter("link_bytes_total", "direction", "rx")
     buf := make([]byte, 65536)
     n := 0
     s := 0
@@ -37,11 +41,12 @@ func Receiver(conn net.Conn, q_recv chan<- Command, q_wait <-chan bool, running
 	    return fmt.Errorf("no read")
 	}
 	n += r
+	rx.Add(int64(r))
 	for s < n {
-	    //tag.Printf("try to parse buf[%d:%d]\n", s, n)
+	    tag.Debugf("try to parse buf[%d:%d]", s, n)
 	    cmd, clen := ParseCommand(buf[s:n])
 	    if clen == 0 {
-		//tag.Printf("not enough buffer (clen == 0)\n")
+		tag.Debugf("not enough buffer (clen == 0)")
 		break
 	    }
 	    if clen == -1 {
@@ -52,14 +57,12 @@ func Receiver(conn net.Conn, q_recv chan<- Command, q_wait <-chan bool, running
 		return fmt.Errorf("command parse error: %v", buf[s:n])
 	    }
 	    q_recv <- cmd
-	    // wait to finish command done
-	    <-q_wait
 	    s += clen
 	}
 	if s < n {
-	    //tag.Printf("check %d %d\n", s, n)
+	    tag.Debugf("check %d %d", s, n)
 	    if s > 32768 {
-		tag.Printf("slide buffer %d %d\n", s, n)
+		tag.Debugf("slide buffer %d %d", s, n)
 		copy(buf, buf[s:n])
 		n -= s
 		s = 0
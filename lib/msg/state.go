@@ -0,0 +1,107 @@
+// HTTP frontline / lib/msg
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package msg
+
+import (
+    "fmt"
+
+    "frontline/lib/log"
+    "frontline/lib/stats"
+)
+
+func init() {
+    stats.Help("connection_invalid_transitions_total", "Connection state changes rejected as invalid.")
+}
+
+// State is the lifecycle of a connection slot.
+type State int
+
+const (
+    // free to be used
+    Idle State = iota
+    // waiting for ConnectAck
+    Connecting
+    // data flows both ways
+    Established
+    // one side is done, data flows the other way
+    HalfClosed
+    // Run is ending, late commands are dropped
+    Closing
+    // kept unused for a while so that the peer does not reuse the id early
+    Cooldown
+)
+
+var stateNames = []string{ "idle", "connecting", "established", "half-closed", "closing", "cooldown" }
+
+func (s State)String() string {
+    if s < 0 || int(s) >= len(stateNames) {
+	return fmt.Sprintf("state(%d)", int(s))
+    }
+    return stateNames[s]
+}
+
+// transitions lists the states reachable from each state.
+var transitions = map[State][]State{
+    Idle: { Connecting },
+    Connecting: { Established, Closing },
+    Established: { HalfClosed, Closing },
+    HalfClosed: { Closing },
+    Closing: { Cooldown },
+    Cooldown: { Idle },
+}
+
+// running reports whether Run reads the queues in s.
+func (s State)running() bool {
+    return s == Connecting || s == Established || s == HalfClosed
+}
+
+// setState moves c to next, c.mu must be held.
+func (c *Connection)setState(next State) error {
+    prev := c.state
+    ok := false
+    for _, s := range transitions[prev] {
+	if s == next {
+	    ok = true
+	    break
+	}
+    }
+    tag := log.NewTag("conn", "conn", c.Id)
+    if !ok {
+	stats.Counter("connection_invalid_transitions_total").Inc()
+	tag.Warnf("invalid state change %s -> %s", prev, next)
+	return fmt.Errorf("conn %d: invalid state change %s -> %s", c.Id, prev, next)
+    }
+    c.state = next
+    if next == Established {
+	c.connected = true
+    }
+    tag.Debugf("state %s -> %s", prev, next)
+    return nil
+}
+
+// Transition moves c to next, an invalid change is rejected.
+func (c *Connection)Transition(next State) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.setState(next)
+}
+
+// State returns the current state.
+func (c *Connection)State() State {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.state
+}
+
+// Open takes an idle slot for a new connection and clears what the last
+// one left.
+func (c *Connection)Open() error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if err := c.setState(Connecting); err != nil {
+	return err
+    }
+    c.flushQ()
+    return nil
+}
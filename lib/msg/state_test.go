@@ -0,0 +1,80 @@
+// HTTP frontline / lib/msg
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package msg
+
+import (
+    "testing"
+
+    "frontline/lib/stats"
+)
+
+func TestStateLifecycle(t *testing.T) {
+    c := &Connection{}
+    c.Init(1)
+    if err := c.Open(); err != nil {
+	t.Fatalf("Open: %v", err)
+    }
+    for _, next := range []State{ Established, HalfClosed, Closing, Cooldown, Idle } {
+	if err := c.Transition(next); err != nil {
+	    t.Fatalf("%v", err)
+	}
+	if got := c.State(); got != next {
+	    t.Fatalf("state %s, want %s", got, next)
+	}
+    }
+    if !c.Connected() {
+	t.Errorf("not connected after established")
+    }
+    // a refused connect skips the tunnel
+    if err := c.Open(); err != nil {
+	t.Fatalf("Open again: %v", err)
+    }
+    if c.Connected() {
+	t.Errorf("connected after Open")
+    }
+    for _, next := range []State{ Closing, Cooldown, Idle } {
+	if err := c.Transition(next); err != nil {
+	    t.Fatalf("%v", err)
+	}
+    }
+}
+
+func TestStateInvalid(t *testing.T) {
+    invalid := stats.Counter("connection_invalid_transitions_total")
+    c := &Connection{}
+    c.Init(2)
+    tests := []struct {
+	from, next State
+    }{
+	{ Idle, Established },
+	{ Idle, Closing },
+	{ Connecting, HalfClosed },
+	{ Established, Connecting },
+	{ HalfClosed, Established },
+	{ Closing, Idle },
+	{ Cooldown, Connecting },
+	{ Established, Established },
+    }
+    for _, tt := range tests {
+	c.state = tt.from
+	before := invalid.Get()
+	if err := c.Transition(tt.next); err == nil {
+	    t.Errorf("%s -> %s accepted", tt.from, tt.next)
+	}
+	if got := c.State(); got != tt.from {
+	    t.Errorf("%s -> %s: state %s", tt.from, tt.next, got)
+	}
+	if n := invalid.Get() - before; n != 1 {
+	    t.Errorf("%s -> %s: counted %d", tt.from, tt.next, n)
+	}
+    }
+    // a slot in use can not be opened
+    c.state = Established
+    if err := c.Open(); err == nil {
+	t.Errorf("Open in established")
+    }
+    if s := State(9).String(); s != "state(9)" {
+	t.Errorf("unknown state %s", s)
+    }
+}
@@ -0,0 +1,141 @@
+// HTTP frontline / lib/pac
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package pac
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/http"
+    "strings"
+    "sync"
+
+    "frontline/lib/log"
+    "frontline/lib/stats"
+)
+
+func init() {
+    stats.Help("pac_requests_total", "Proxy auto-config files served by path.")
+}
+
+// Config is the proxy auto-config served by backline.
+type Config struct {
+    // http address to serve the file, empty disables it
+    Listen string `json:"listen"`
+    // host:port the browsers use, the requested host and the listen port
+    // of backline if empty
+    Proxy string `json:"proxy"`
+    // also answer /wpad.dat
+    WPAD bool `json:"wpad"`
+}
+
+func (c *Config)Validate() error {
+    if c.Listen == "" {
+	return nil
+    }
+    if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+	return fmt.Errorf("listen: %v", err)
+    }
+    if c.Proxy != "" {
+	if _, _, err := net.SplitHostPort(c.Proxy); err != nil {
+	    return fmt.Errorf("proxy: %v", err)
+	}
+    }
+    return nil
+}
+
+// Rule is a split rule of backline reduced to what a browser can check.
+type Rule struct {
+    // domain and its subdomains, empty for any host
+    Domain string
+    // the rule also has a CIDR or port, it matches only some of Domain
+    Partial bool
+    Direct bool
+}
+
+func quote(s string) string {
+    b, _ := json.Marshal(s)
+    return string(b)
+}
+
+// Generate writes FindProxyForURL sending hosts to proxy unless the split
+// rules dial them directly. Backline checks the rules again, so a host is
+// only DIRECT when backline would dial it directly as well.
+func Generate(rules []Rule, proxy string) string {
+    tunnel := quote("PROXY " + proxy)
+    direct := quote("DIRECT")
+    w := &bytes.Buffer{}
+    fmt.Fprintf(w, "function FindProxyForURL(url, host) {\n")
+    fmt.Fprintf(w, "    host = host.toLowerCase();\n")
+    for _, r := range rules {
+	if r.Direct && r.Partial {
+	    // backline dials it directly
+	    continue
+	}
+	if r.Domain == "" {
+	    // it may match any host, backline decides for the rest
+	    break
+	}
+	action := tunnel
+	if r.Direct {
+	    action = direct
+	}
+	d := strings.ToLower(r.Domain)
+	fmt.Fprintf(w, "    if (host == %s || dnsDomainIs(host, %s)) return %s;\n", quote(d), quote("." + d), action)
+    }
+    fmt.Fprintf(w, "    return %s;\n", tunnel)
+    fmt.Fprintf(w, "}\n")
+    return w.String()
+}
+
+var (
+    lock sync.Mutex
+    current *Config
+    currentRules []Rule
+    listenPort string
+)
+
+// Configure sets the file served for the split rules, listen is the proxy
+// address of backline.
+func Configure(c *Config, rules []Rule, listen string) {
+    _, port, _ := net.SplitHostPort(listen)
+    lock.Lock()
+    current = c
+    currentRules = rules
+    listenPort = port
+    lock.Unlock()
+}
+
+func handler(w http.ResponseWriter, r *http.Request) {
+    lock.Lock()
+    c, rules, port := current, currentRules, listenPort
+    lock.Unlock()
+    if c == nil || (r.URL.Path == "/wpad.dat" && !c.WPAD) {
+	http.NotFound(w, r)
+	return
+    }
+    proxy := c.Proxy
+    if proxy == "" {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+	    host = strings.Trim(r.Host, "[]")
+	}
+	proxy = net.JoinHostPort(host, port)
+    }
+    stats.Counter("pac_requests_total", "path", r.URL.Path).Inc()
+    log.NewTag("pac", "client", r.RemoteAddr, "path", r.URL.Path).Debugf("serve proxy %s", proxy)
+    w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+    w.Header().Set("Cache-Control", "no-cache")
+    fmt.Fprint(w, Generate(rules, proxy))
+}
+
+// Serve serves http://addr/proxy.pac and /wpad.dat.
+func Serve(addr string) error {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/proxy.pac", handler)
+    mux.HandleFunc("/wpad.dat", handler)
+    log.NewTag("pac").Printf("listen %s", addr)
+    return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,52 @@
+// HTTP frontline / lib/pac
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package pac
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestGenerate(t *testing.T) {
+    rules := []Rule{
+	// a tunneled subdomain before its direct domain keeps the tunnel
+	{ Domain: "secure.corp.example" },
+	{ Domain: "Corp.Example", Direct: true },
+	// only some hosts of it go direct, backline decides
+	{ Domain: "ssh.example", Partial: true, Direct: true },
+	// a rejected or partly tunneled domain must not fall to a later DIRECT
+	{ Domain: "blocked.example", Partial: true },
+	{ Domain: "ssh.example", Direct: true },
+	// it may match any host, nothing after it is DIRECT
+	{ Partial: true },
+	{ Domain: "late.example", Direct: true },
+    }
+    want := `function FindProxyForURL(url, host) {
+    host = host.toLowerCase();
+    if (host == "secure.corp.example" || dnsDomainIs(host, ".secure.corp.example")) return "PROXY backline:8443";
+    if (host == "corp.example" || dnsDomainIs(host, ".corp.example")) return "DIRECT";
+    if (host == "blocked.example" || dnsDomainIs(host, ".blocked.example")) return "PROXY backline:8443";
+    if (host == "ssh.example" || dnsDomainIs(host, ".ssh.example")) return "DIRECT";
+    return "PROXY backline:8443";
+}
+`
+    if got := Generate(rules, "backline:8443"); got != want {
+	t.Errorf("got\n%s\nwant\n%s", got, want)
+    }
+}
+
+func TestGenerateDefault(t *testing.T) {
+    // a direct rule for every host is left to backline
+    for _, rules := range [][]Rule{ nil, { { Partial: true, Direct: true } } } {
+	got := Generate(rules, "[::1]:8443")
+	if strings.Contains(got, "DIRECT") || !strings.Contains(got, `return "PROXY [::1]:8443";`) {
+	    t.Errorf("%v: got\n%s", rules, got)
+	}
+    }
+    // quoted for JavaScript
+    got := Generate([]Rule{ { Domain: `a"b.example`, Direct: true } }, "p:1")
+    if !strings.Contains(got, `host == "a\"b.example"`) {
+	t.Errorf("got\n%s", got)
+    }
+}
@@ -0,0 +1,363 @@
+// HTTP frontline / lib/quota
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package quota
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "frontline/lib/stats"
+)
+
+func init() {
+    stats.Help("quota_rejects_total", "Connections refused by quota, by limit.")
+    stats.Help("quota_cancels_total", "Running connections canceled over a byte quota, by limit.")
+}
+
+// Rule limits the backlines and users matching it. The limits are per
+// user when User is given, otherwise shared by the backline.
+type Rule struct {
+    // glob on the backline identity, "office-*"
+    Backline string `json:"backline,omitempty"`
+    // glob on the user backline sends, it is trusted as far as the
+    // backline is
+    User string `json:"user,omitempty"`
+    // tunnels at the same time, 0 for no limit
+    MaxConns int `json:"max_conns,omitempty"`
+    // new tunnels per second
+    ConnectRate float64 `json:"connect_rate,omitempty"`
+    // bytes up and down per day and month (k, m, g, t suffix)
+    DailyBytes string `json:"daily_bytes,omitempty"`
+    MonthlyBytes string `json:"monthly_bytes,omitempty"`
+    daily, monthly int64
+}
+
+// Config is the quota configuration of frontline.
+type Config struct {
+    Rules []*Rule `json:"rules"`
+    // file keeping the byte counters over restarts
+    State string `json:"state"`
+}
+
+func parseSize(s string) (int64, error) {
+    if s == "" {
+	return 0, nil
+    }
+    mul := int64(1)
+    v := strings.ToLower(strings.TrimSpace(s))
+    switch {
+    case strings.HasSuffix(v, "k"): mul = 1 << 10
+    case strings.HasSuffix(v, "m"): mul = 1 << 20
+    case strings.HasSuffix(v, "g"): mul = 1 << 30
+    case strings.HasSuffix(v, "t"): mul = 1 << 40
+    }
+    if mul > 1 {
+	v = v[:len(v) - 1]
+    }
+    n, err := strconv.ParseInt(v, 10, 64)
+    if err != nil || n < 0 {
+	return 0, fmt.Errorf("bad size %s", s)
+    }
+    return n * mul, nil
+}
+
+func (c *Config)Validate() error {
+    for i, r := range c.Rules {
+	if _, err := path.Match(r.Backline, ""); err != nil {
+	    return fmt.Errorf("rules[%d]: bad backline %s", i, r.Backline)
+	}
+	if _, err := path.Match(r.User, ""); err != nil {
+	    return fmt.Errorf("rules[%d]: bad user %s", i, r.User)
+	}
+	if r.MaxConns < 0 || r.ConnectRate < 0 {
+	    return fmt.Errorf("rules[%d]: limits must not be negative", i)
+	}
+	var err error
+	if r.daily, err = parseSize(r.DailyBytes); err != nil {
+	    return fmt.Errorf("rules[%d]: daily_bytes: %v", i, err)
+	}
+	if r.monthly, err = parseSize(r.MonthlyBytes); err != nil {
+	    return fmt.Errorf("rules[%d]: monthly_bytes: %v", i, err)
+	}
+    }
+    return nil
+}
+
+func (r *Rule)match(backline, user string) bool {
+    if r.Backline != "" {
+	if ok, _ := path.Match(r.Backline, backline); !ok {
+	    return false
+	}
+    }
+    if r.User != "" {
+	if ok, _ := path.Match(r.User, user); !ok {
+	    return false
+	}
+    }
+    return true
+}
+
+// usage of one backline or user, the byte counters are saved.
+type usage struct {
+    Day string `json:"day"`
+    DayBytes int64 `json:"day_bytes"`
+    Month string `json:"month"`
+    MonthBytes int64 `json:"month_bytes"`
+    conns int
+    tokens float64
+    last time.Time
+}
+
+// roll starts new counters when the day or month changed.
+func (u *usage)roll(now time.Time) {
+    if day := now.Format("2006-01-02"); u.Day != day {
+	u.Day, u.DayBytes = day, 0
+    }
+    if month := now.Format("2006-01"); u.Month != month {
+	u.Month, u.MonthBytes = month, 0
+    }
+}
+
+// Error tells backline which limit refused the connection.
+type Error struct {
+    Limit string
+    Key string
+}
+
+func (e *Error)Error() string {
+    return fmt.Sprintf("quota: %s exceeded for %s", e.Limit, e.Key)
+}
+
+// Ticket is a granted connection, count its bytes with Use and give it
+// back with Release.
+type Ticket struct {
+    u *usage
+    rule *Rule
+    key string
+    // bytes already counted
+    counted int64
+}
+
+// Manager enforces the rules, the counters survive reloads.
+type Manager struct {
+    mu sync.Mutex
+    rules []*Rule
+    usage map[string]*usage
+    state string
+    dirty bool
+}
+
+func NewManager() *Manager {
+    return &Manager{ usage: map[string]*usage{} }
+}
+
+// Staged is a configuration with its state file read, the manager keeps
+// the current one until Apply.
+type Staged struct {
+    rules []*Rule
+    state string
+    // counters of a new state file
+    saved map[string]*usage
+}
+
+// Stage reads the state file of c when it is not the one in use.
+func (m *Manager)Stage(c *Config) (*Staged, error) {
+    st := &Staged{ rules: c.Rules, state: c.State }
+    m.mu.Lock()
+    same := c.State == m.state
+    m.mu.Unlock()
+    if same || c.State == "" {
+	return st, nil
+    }
+    buf, err := ioutil.ReadFile(c.State)
+    if os.IsNotExist(err) {
+	return st, nil
+    }
+    if err != nil {
+	return nil, err
+    }
+    saved := map[string]*usage{}
+    if err := json.Unmarshal(buf, &saved); err != nil {
+	return nil, fmt.Errorf("%s: %v", c.State, err)
+    }
+    st.saved = saved
+    return st, nil
+}
+
+// Apply sets the rules of st and loads its counters.
+func (m *Manager)Apply(st *Staged) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.rules = st.rules
+    m.state = st.state
+    for k, s := range st.saved {
+	u := m.get(k)
+	u.Day, u.DayBytes, u.Month, u.MonthBytes = s.Day, s.DayBytes, s.Month, s.MonthBytes
+    }
+}
+
+// Configure sets the rules and loads the state file when it changed.
+func (m *Manager)Configure(c *Config) error {
+    st, err := m.Stage(c)
+    if err != nil {
+	return err
+    }
+    m.Apply(st)
+    return nil
+}
+
+func (m *Manager)get(key string) *usage {
+    u, ok := m.usage[key]
+    if !ok {
+	u = &usage{}
+	m.usage[key] = u
+    }
+    return u
+}
+
+// Acquire checks the limits of the first matching rule for a new
+// connection of the backline identity id and user.
+func (m *Manager)Acquire(id, user string) (*Ticket, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    var rule *Rule
+    for _, r := range m.rules {
+	if r.match(id, user) {
+	    rule = r
+	    break
+	}
+    }
+    if rule == nil {
+	return &Ticket{}, nil
+    }
+    key := id
+    if rule.User != "" {
+	key += "/" + user
+    }
+    u := m.get(key)
+    now := time.Now()
+    u.roll(now)
+    limit := ""
+    switch {
+    case rule.MaxConns > 0 && u.conns >= rule.MaxConns:
+	limit = "max_conns"
+    case rule.daily > 0 && u.DayBytes >= rule.daily:
+	limit = "daily_bytes"
+    case rule.monthly > 0 && u.MonthBytes >= rule.monthly:
+	limit = "monthly_bytes"
+    case rule.ConnectRate > 0:
+	// token bucket holding a second of connects
+	burst := rule.ConnectRate
+	if burst < 1 {
+	    burst = 1
+	}
+	if u.last.IsZero() {
+	    u.tokens = burst
+	} else {
+	    u.tokens += now.Sub(u.last).Seconds() * rule.ConnectRate
+	    if u.tokens > burst {
+		u.tokens = burst
+	    }
+	}
+	u.last = now
+	if u.tokens < 1 {
+	    limit = "connect_rate"
+	} else {
+	    u.tokens--
+	}
+    }
+    if limit != "" {
+	stats.Counter("quota_rejects_total", "limit", limit).Inc()
+	return nil, &Error{ Limit: limit, Key: key }
+    }
+    u.conns++
+    return &Ticket{ u: u, rule: rule, key: key }, nil
+}
+
+// count adds the bytes of t up to total, m.mu must be held.
+func (m *Manager)count(t *Ticket, total int64) {
+    u := t.u
+    u.roll(time.Now())
+    if d := total - t.counted; d > 0 {
+	u.DayBytes += d
+	u.MonthBytes += d
+	t.counted = total
+	m.dirty = true
+    }
+}
+
+// Use counts the bytes of the running connection of t, total is all its
+// bytes so far. The error tells that a byte limit is reached and the
+// connection should stop.
+func (m *Manager)Use(t *Ticket, total int64) error {
+    if t == nil || t.u == nil {
+	return nil
+    }
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.count(t, total)
+    u, rule := t.u, t.rule
+    limit := ""
+    switch {
+    case rule.daily > 0 && u.DayBytes >= rule.daily:
+	limit = "daily_bytes"
+    case rule.monthly > 0 && u.MonthBytes >= rule.monthly:
+	limit = "monthly_bytes"
+    }
+    if limit != "" {
+	stats.Counter("quota_cancels_total", "limit", limit).Inc()
+	return &Error{ Limit: limit, Key: t.key }
+    }
+    return nil
+}
+
+// Release ends the connection of t and counts the rest of its bytes.
+func (m *Manager)Release(t *Ticket, total int64) {
+    if t == nil || t.u == nil {
+	return
+    }
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.count(t, total)
+    t.u.conns--
+    t.u = nil
+}
+
+// Save writes the byte counters to the state file if they changed.
+func (m *Manager)Save() error {
+    m.mu.Lock()
+    if m.state == "" || !m.dirty {
+	m.mu.Unlock()
+	return nil
+    }
+    buf, err := json.MarshalIndent(m.usage, "", "  ")
+    state := m.state
+    m.dirty = false
+    m.mu.Unlock()
+    if err == nil {
+	err = writeFile(state, buf)
+    }
+    if err != nil {
+	m.mu.Lock()
+	m.dirty = true
+	m.mu.Unlock()
+    }
+    return err
+}
+
+func writeFile(state string, buf []byte) error {
+    // replace the file at once, a crash keeps the old one
+    tmp := state + ".tmp"
+    if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+	return err
+    }
+    return os.Rename(tmp, state)
+}
@@ -0,0 +1,111 @@
+// HTTP frontline / lib/quota
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package quota
+
+import (
+    "path/filepath"
+    "testing"
+)
+
+func newManager(t *testing.T, c *Config) *Manager {
+    if err := c.Validate(); err != nil {
+	t.Fatal(err)
+    }
+    m := NewManager()
+    if err := m.Configure(c); err != nil {
+	t.Fatal(err)
+    }
+    return m
+}
+
+// limit returns the limit in err, "" for no error.
+func limit(t *testing.T, err error) string {
+    if err == nil {
+	return ""
+    }
+    qerr, ok := err.(*Error)
+    if !ok {
+	t.Fatalf("unexpected error %v", err)
+    }
+    return qerr.Limit
+}
+
+func TestMaxConns(t *testing.T) {
+    m := newManager(t, &Config{ Rules: []*Rule{
+	{ Backline: "office-*", User: "*", MaxConns: 1 },
+    }})
+    a, err := m.Acquire("office-1", "alice")
+    if err != nil {
+	t.Fatal(err)
+    }
+    if _, err := m.Acquire("office-1", "alice"); limit(t, err) != "max_conns" {
+	t.Errorf("second connection of alice: %v", err)
+    }
+    // the limit is per user
+    if _, err := m.Acquire("office-1", "bob"); err != nil {
+	t.Errorf("bob: %v", err)
+    }
+    m.Release(a, 0)
+    if _, err := m.Acquire("office-1", "alice"); err != nil {
+	t.Errorf("after release: %v", err)
+    }
+    // no rule, no limit
+    for i := 0; i < 3; i++ {
+	if _, err := m.Acquire("lab-1", "alice"); err != nil {
+	    t.Errorf("lab-1: %v", err)
+	}
+    }
+}
+
+func TestDailyBytes(t *testing.T) {
+    m := newManager(t, &Config{ Rules: []*Rule{
+	{ Backline: "office-*", DailyBytes: "1k" },
+    }})
+    a, _ := m.Acquire("office-1", "")
+    b, _ := m.Acquire("office-2", "")
+    if err := m.Use(a, 600); err != nil {
+	t.Errorf("600 bytes: %v", err)
+    }
+    // the total is counted once
+    if err := m.Use(a, 600); err != nil {
+	t.Errorf("600 bytes again: %v", err)
+    }
+    if err := m.Use(a, 1100); limit(t, err) != "daily_bytes" {
+	t.Errorf("1100 bytes: %v", err)
+    }
+    if _, err := m.Acquire("office-1", ""); limit(t, err) != "daily_bytes" {
+	t.Errorf("new connection over the limit: %v", err)
+    }
+    // shared by the backline, not by the rule
+    if err := m.Use(b, 1000); err != nil {
+	t.Errorf("office-2: %v", err)
+    }
+    m.Release(a, 1200)
+    m.Release(b, 1000)
+}
+
+func TestStateFile(t *testing.T) {
+    state := filepath.Join(t.TempDir(), "quota.json")
+    c := &Config{ Rules: []*Rule{ { DailyBytes: "1k" } }, State: state }
+    m := newManager(t, c)
+    a, _ := m.Acquire("office-1", "")
+    m.Release(a, 2000)
+    if err := m.Save(); err != nil {
+	t.Fatal(err)
+    }
+    // the counters survive a restart
+    m = newManager(t, c)
+    if _, err := m.Acquire("office-1", ""); limit(t, err) != "daily_bytes" {
+	t.Errorf("after restart: %v", err)
+    }
+    // and a reload with the same state file keeps the running ones
+    b, _ := m.Acquire("office-2", "")
+    m.Use(b, 500)
+    if err := m.Configure(c); err != nil {
+	t.Fatal(err)
+    }
+    if err := m.Use(b, 1100); limit(t, err) != "daily_bytes" {
+	t.Errorf("after reload: %v", err)
+    }
+}
@@ -0,0 +1,247 @@
+// HTTP frontline / lib/ratelimit
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package ratelimit
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "frontline/lib/match"
+    "frontline/lib/stats"
+)
+
+const minBurst = 4096
+
+func init() {
+    stats.Help("rate_bytes_per_second", "Measured throughput of rate limited scopes.")
+}
+
+// Bucket is a token bucket in bytes per second which also measures the
+// current throughput. Rate 0 means unlimited.
+type Bucket struct {
+    mu sync.Mutex
+    rate int64
+    tokens float64
+    last time.Time
+    // meter
+    win time.Time
+    winBytes int64
+    current float64
+}
+
+func NewBucket(rate int64) *Bucket {
+    now := time.Now()
+    b := &Bucket{
+	last: now,
+	win: now,
+    }
+    b.SetRate(rate)
+    return b
+}
+
+func (b *Bucket)burst() float64 {
+    if b.rate < minBurst {
+	return minBurst
+    }
+    return float64(b.rate)
+}
+
+func (b *Bucket)SetRate(rate int64) {
+    b.mu.Lock()
+    b.rate = rate
+    b.tokens = b.burst()
+    b.mu.Unlock()
+}
+
+func (b *Bucket)Limit() int64 {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.rate
+}
+
+func (b *Bucket)meter(now time.Time, n int) {
+    if d := now.Sub(b.win); d >= time.Second {
+	b.current = float64(b.winBytes) / d.Seconds()
+	b.win = now
+	b.winBytes = 0
+    }
+    b.winBytes += int64(n)
+}
+
+// Wait takes n bytes worth of tokens, sleeping until they are available.
+func (b *Bucket)Wait(n int) {
+    if b == nil {
+	return
+    }
+    b.mu.Lock()
+    now := time.Now()
+    b.meter(now, n)
+    if b.rate <= 0 {
+	b.mu.Unlock()
+	return
+    }
+    b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+    b.last = now
+    if burst := b.burst(); b.tokens > burst {
+	b.tokens = burst
+    }
+    b.tokens -= float64(n)
+    var wait time.Duration
+    if b.tokens < 0 {
+	wait = time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+    }
+    b.mu.Unlock()
+    if wait > 0 {
+	time.Sleep(wait)
+    }
+}
+
+// Rate returns the measured throughput in bytes per second.
+func (b *Bucket)Rate() float64 {
+    if b == nil {
+	return 0
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if time.Since(b.win) >= time.Second * 2 {
+	return 0
+    }
+    return b.current
+}
+
+// Set is the list of buckets applied to one connection.
+type Set struct {
+    buckets []*Bucket
+    conn *Bucket
+}
+
+func (s *Set)Wait(n int) {
+    if s == nil {
+	return
+    }
+    for _, b := range s.buckets {
+	b.Wait(n)
+    }
+}
+
+// Rate returns the measured throughput of the connection.
+func (s *Set)Rate() float64 {
+    if s == nil {
+	return 0
+    }
+    return s.conn.Rate()
+}
+
+type Rule struct {
+    Pattern *match.Pattern
+    bucket *Bucket
+}
+
+// Limiter holds the limits for the whole supply line, per connection and
+// per destination pattern.
+type Limiter struct {
+    mu sync.Mutex
+    link *Bucket
+    connRate int64
+    rules []*Rule
+}
+
+func NewLimiter(linkRate, connRate int64) *Limiter {
+    l := &Limiter{
+	link: NewBucket(linkRate),
+	connRate: connRate,
+    }
+    stats.GaugeFunc("rate_bytes_per_second", l.link.Rate, "scope", "link")
+    return l
+}
+
+// SetRates changes the supply line and per connection limits.
+func (l *Limiter)SetRates(linkRate, connRate int64) {
+    if l.link.Limit() != linkRate {
+	l.link.SetRate(linkRate)
+    }
+    l.mu.Lock()
+    l.connRate = connRate
+    l.mu.Unlock()
+}
+
+// SetRules replaces the destination rules. The buckets of patterns which
+// are kept are reused, running connections keep the buckets they got.
+func (l *Limiter)SetRules(patterns []string, rates []int64) error {
+    if len(patterns) != len(rates) {
+	return fmt.Errorf("%d patterns for %d rates", len(patterns), len(rates))
+    }
+    rules := []*Rule{}
+    for _, pattern := range patterns {
+	p, err := match.Parse(pattern)
+	if err != nil {
+	    return err
+	}
+	rules = append(rules, &Rule{ Pattern: p })
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    old := map[string]*Rule{}
+    for _, r := range l.rules {
+	old[r.Pattern.String()] = r
+    }
+    for i, r := range rules {
+	key := r.Pattern.String()
+	if o, ok := old[key]; ok {
+	    r.bucket = o.bucket
+	    if r.bucket.Limit() != rates[i] {
+		r.bucket.SetRate(rates[i])
+	    }
+	    delete(old, key)
+	} else {
+	    r.bucket = NewBucket(rates[i])
+	    stats.GaugeFunc("rate_bytes_per_second", r.bucket.Rate, "scope", "dest", "pattern", key)
+	}
+    }
+    for key := range old {
+	stats.Remove("rate_bytes_per_second", "scope", "dest", "pattern", key)
+    }
+    l.rules = rules
+    return nil
+}
+
+// For returns the buckets for a new connection to hostport.
+func (l *Limiter)For(hostport string) *Set {
+    if l == nil {
+	return nil
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    s := &Set{ conn: NewBucket(l.connRate) }
+    s.buckets = append(s.buckets, s.conn, l.link)
+    for _, r := range l.rules {
+	if r.Pattern.Match(hostport) {
+	    s.buckets = append(s.buckets, r.bucket)
+	    break
+	}
+    }
+    return s
+}
+
+// ParseRate parses bytes per second with an optional k, m or g suffix.
+func ParseRate(s string) (int64, error) {
+    mul := int64(1)
+    v := strings.ToLower(strings.TrimSpace(s))
+    switch {
+    case strings.HasSuffix(v, "k"): mul = 1024
+    case strings.HasSuffix(v, "m"): mul = 1024 * 1024
+    case strings.HasSuffix(v, "g"): mul = 1024 * 1024 * 1024
+    }
+    if mul > 1 {
+	v = v[:len(v) - 1]
+    }
+    n, err := strconv.ParseInt(v, 10, 64)
+    if err != nil || n < 0 {
+	return 0, fmt.Errorf("bad rate %s", s)
+    }
+    return n * mul, nil
+}
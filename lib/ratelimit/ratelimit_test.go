@@ -0,0 +1,83 @@
+// HTTP frontline / lib/ratelimit
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package ratelimit
+
+import (
+    "testing"
+    "time"
+)
+
+func TestParseRate(t *testing.T) {
+    tests := []struct {
+	s string
+	want int64
+	ok bool
+    }{
+	{ "0", 0, true },
+	{ "1000", 1000, true },
+	{ "64k", 64 * 1024, true },
+	{ " 2M ", 2 * 1024 * 1024, true },
+	{ "1g", 1024 * 1024 * 1024, true },
+	{ "", 0, false },
+	{ "k", 0, false },
+	{ "-1k", 0, false },
+	{ "1.5m", 0, false },
+    }
+    for _, tt := range tests {
+	got, err := ParseRate(tt.s)
+	if (err == nil) != tt.ok || got != tt.want {
+	    t.Errorf("%q: got %d, %v", tt.s, got, err)
+	}
+    }
+}
+
+func TestBucketWait(t *testing.T) {
+    b := NewBucket(64 * 1024)
+    // the burst is a second worth of bytes, then it waits
+    start := time.Now()
+    b.Wait(64 * 1024)
+    if d := time.Since(start); d > time.Millisecond * 100 {
+	t.Errorf("burst waited %v", d)
+    }
+    b.Wait(16 * 1024)
+    if d := time.Since(start); d < time.Millisecond * 200 {
+	t.Errorf("over the burst waited only %v", d)
+    }
+    // no limit
+    b = NewBucket(0)
+    start = time.Now()
+    b.Wait(1 << 30)
+    if d := time.Since(start); d > time.Millisecond * 100 {
+	t.Errorf("unlimited waited %v", d)
+    }
+}
+
+func TestLimiterRules(t *testing.T) {
+    l := NewLimiter(0, 0)
+    if err := l.SetRules([]string{ "*.example.com:443", "*:443" }, []int64{ 1024, 2048 }); err != nil {
+	t.Fatal(err)
+    }
+    // the connection, the link and the first matching rule
+    www := l.For("www.example.com:443")
+    if len(www.buckets) != 3 || www.buckets[2].Limit() != 1024 {
+	t.Errorf("www.example.com:443: %d buckets", len(www.buckets))
+    }
+    if org := l.For("example.org:443"); len(org.buckets) != 3 || org.buckets[2].Limit() != 2048 {
+	t.Errorf("example.org:443: %d buckets", len(org.buckets))
+    }
+    if plain := l.For("example.org:80"); len(plain.buckets) != 2 {
+	t.Errorf("example.org:80: %d buckets", len(plain.buckets))
+    }
+    // a kept pattern keeps its bucket with the new rate
+    kept := www.buckets[2]
+    if err := l.SetRules([]string{ "*.example.com:443" }, []int64{ 4096 }); err != nil {
+	t.Fatal(err)
+    }
+    if b := l.For("www.example.com:443").buckets[2]; b != kept || b.Limit() != 4096 {
+	t.Errorf("bucket not kept")
+    }
+    if err := l.SetRules([]string{ "*" }, nil); err == nil {
+	t.Errorf("rates missing")
+    }
+}
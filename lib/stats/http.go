@@ -0,0 +1,54 @@
+// HTTP frontline / lib/stats
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package stats
+
+import (
+    "bytes"
+    "fmt"
+    "net/http"
+    "strconv"
+
+    "frontline/lib/log"
+)
+
+var namespace = ""
+
+// Setup sets the prefix of exported metric names.
+func Setup(cmd string) {
+    namespace = cmd + "_"
+}
+
+// WriteText writes all metrics in the Prometheus text exposition format.
+func WriteText(w *bytes.Buffer) {
+    last := ""
+    Each(func(m *Metric) {
+	name := namespace + m.Name
+	if m.Name != last {
+	    if help := HelpOf(m.Name); help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	    }
+	    fmt.Fprintf(w, "# TYPE %s %s\n", name, m.Type)
+	    last = m.Name
+	}
+	if len(m.Labels) > 0 {
+	    name += "{" + m.LabelString() + "}"
+	}
+	fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(m.Value(), 'g', -1, 64))
+    })
+}
+
+func handler(w http.ResponseWriter, r *http.Request) {
+    buf := &bytes.Buffer{}
+    WriteText(buf)
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    w.Write(buf.Bytes())
+}
+
+// Serve exports metrics on http://addr/metrics.
+func Serve(addr string) error {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/metrics", handler)
+    log.NewTag("metrics").Printf("listen %s", addr)
+    return http.ListenAndServe(addr, mux)
+}
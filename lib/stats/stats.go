@@ -0,0 +1,168 @@
+// HTTP frontline / lib/stats
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package stats
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "frontline/lib/log"
+)
+
+const (
+    counterType = "counter"
+    gaugeType = "gauge"
+)
+
+// Value is a counter or gauge which can be updated from any goroutine.
+type Value struct {
+    v int64
+}
+
+func (v *Value)Add(n int64) {
+    atomic.AddInt64(&v.v, n)
+}
+
+func (v *Value)Inc() {
+    v.Add(1)
+}
+
+func (v *Value)Dec() {
+    v.Add(-1)
+}
+
+func (v *Value)Set(n int64) {
+    atomic.StoreInt64(&v.v, n)
+}
+
+func (v *Value)Get() int64 {
+    return atomic.LoadInt64(&v.v)
+}
+
+type Metric struct {
+    Name string
+    Type string
+    Labels []string
+    value *Value
+    f func() float64
+}
+
+func (m *Metric)Value() float64 {
+    if m.f != nil {
+	return m.f()
+    }
+    return float64(m.value.Get())
+}
+
+func (m *Metric)key() string {
+    return m.Name + "{" + strings.Join(m.Labels, ",") + "}"
+}
+
+// LabelString returns labels in the form of key="value",...
+func (m *Metric)LabelString() string {
+    l := []string{}
+    for i := 0; i + 1 < len(m.Labels); i += 2 {
+	l = append(l, fmt.Sprintf("%s=%q", m.Labels[i], m.Labels[i + 1]))
+    }
+    return strings.Join(l, ",")
+}
+
+var (
+    lock sync.Mutex
+    metrics = map[string]*Metric{}
+    helps = map[string]string{}
+)
+
+func lookup(name, typ string, labels []string) *Metric {
+    m := &Metric{ Name: name, Type: typ, Labels: labels }
+    lock.Lock()
+    defer lock.Unlock()
+    if e, ok := metrics[m.key()]; ok {
+	return e
+    }
+    m.value = &Value{}
+    metrics[m.key()] = m
+    return m
+}
+
+// Counter returns the counter for name and label pairs, creating it on demand.
+func Counter(name string, labels ...string) *Value {
+    return lookup(name, counterType, labels).value
+}
+
+// Gauge returns the gauge for name and label pairs, creating it on demand.
+func Gauge(name string, labels ...string) *Value {
+    return lookup(name, gaugeType, labels).value
+}
+
+// GaugeFunc registers a gauge whose value is computed by f.
+func GaugeFunc(name string, f func() float64, labels ...string) {
+    lookup(name, gaugeType, labels).f = f
+}
+
+// CounterFunc registers a counter whose value is computed by f.
+func CounterFunc(name string, f func() float64, labels ...string) {
+    lookup(name, counterType, labels).f = f
+}
+
+// Remove drops a metric, used for per-link metrics.
+func Remove(name string, labels ...string) {
+    m := &Metric{ Name: name, Labels: labels }
+    lock.Lock()
+    delete(metrics, m.key())
+    lock.Unlock()
+}
+
+func Help(name, help string) {
+    lock.Lock()
+    helps[name] = help
+    lock.Unlock()
+}
+
+func HelpOf(name string) string {
+    lock.Lock()
+    defer lock.Unlock()
+    return helps[name]
+}
+
+// Each calls f for all metrics sorted by name.
+func Each(f func(m *Metric)) {
+    lock.Lock()
+    list := []*Metric{}
+    for _, m := range metrics {
+	list = append(list, m)
+    }
+    lock.Unlock()
+    sort.Slice(list, func(i, j int) bool {
+	return list[i].key() < list[j].key()
+    })
+    for _, m := range list {
+	f(m)
+    }
+}
+
+func String() string {
+    s := []string{}
+    Each(func(m *Metric) {
+	name := m.Name
+	if len(m.Labels) > 0 {
+	    name += "{" + m.LabelString() + "}"
+	}
+	s = append(s, fmt.Sprintf("%s=%v", name, m.Value()))
+    })
+    return strings.Join(s, " ")
+}
+
+// Report logs all metrics periodically.
+func Report(interval time.Duration) {
+    tag := log.NewTag("stats")
+    for {
+	time.Sleep(interval)
+	tag.Debugf("%s", String())
+    }
+}
@@ -0,0 +1,32 @@
+// HTTP frontline / lib/supplyline
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package supplyline
+
+import (
+    "time"
+
+    "frontline/lib/log"
+    "frontline/lib/msg"
+)
+
+// Drain tells the peer that the supply line is going away if it has caps
+// for it and waits for running connections until deadline. The rest are
+// disconnected.
+func Drain(cm *msg.ConnectionManager, q_req chan<- []byte, caps int, deadline time.Time) {
+    if caps & msg.CapGoaway != 0 {
+	q_req <- msg.PackedGoawayCommand()
+    }
+    for cm.ActiveCount() > 0 && time.Now().Before(deadline) {
+	time.Sleep(time.Millisecond * 200)
+    }
+    for _, info := range cm.Active() {
+	log.NewTag("drain", "conn", info.Id, "hostport", info.HostPort).Printf("disconnect")
+	cm.Get(info.Id).Cancel()
+    }
+    // let the connections send DisconnectCommand and the writer flush
+    for i := 0; i < 10 && (cm.ActiveCount() > 0 || len(q_req) > 0); i++ {
+	time.Sleep(time.Millisecond * 100)
+    }
+    time.Sleep(time.Millisecond * 100)
+}
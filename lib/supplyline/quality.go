@@ -0,0 +1,115 @@
+// HTTP frontline / lib/supplyline
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package supplyline
+
+import (
+    "fmt"
+    "sync"
+    "time"
+
+    "frontline/lib/stats"
+)
+
+func init() {
+    stats.Help("keepalive_rtt_seconds", "Last keepalive round trip time.")
+    stats.Help("keepalive_jitter_seconds", "Keepalive round trip time jitter.")
+    stats.Help("keepalive_lost_total", "Keepalives not echoed in time.")
+}
+
+// Quality measures the supply line with echoed keepalives.
+type Quality struct {
+    mu sync.Mutex
+    rtt time.Duration
+    jitter time.Duration
+    sent int
+    lost int
+    // lost in a row
+    missed int
+    pending time.Time
+}
+
+// Sent records a keepalive sent at t. A previous keepalive which has not
+// been echoed yet is counted as lost.
+func (q *Quality)Sent(t time.Time) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if !q.pending.IsZero() {
+	q.lost++
+	q.missed++
+    }
+    q.sent++
+    q.pending = t
+}
+
+// Ack records the echo of the keepalive sent at t.
+func (q *Quality)Ack(t time.Time) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    rtt := time.Since(t)
+    if rtt < 0 {
+	return
+    }
+    if q.rtt > 0 {
+	// RFC 3550 style smoothing
+	d := rtt - q.rtt
+	if d < 0 {
+	    d = -d
+	}
+	q.jitter += (d - q.jitter) / 16
+    }
+    q.rtt = rtt
+    if t.Equal(q.pending) {
+	q.pending = time.Time{}
+	q.missed = 0
+    }
+}
+
+func (q *Quality)RTT() time.Duration {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return q.rtt
+}
+
+func (q *Quality)Jitter() time.Duration {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return q.jitter
+}
+
+func (q *Quality)Lost() int {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return q.lost
+}
+
+// Missed returns the number of keepalives lost in a row.
+func (q *Quality)Missed() int {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return q.missed
+}
+
+func (q *Quality)String() string {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return fmt.Sprintf("rtt %v jitter %v lost %d/%d", q.rtt, q.jitter, q.lost, q.sent)
+}
+
+func (q *Quality)register(peer string) {
+    stats.GaugeFunc("keepalive_rtt_seconds", func() float64 {
+	return q.RTT().Seconds()
+    }, "peer", peer)
+    stats.GaugeFunc("keepalive_jitter_seconds", func() float64 {
+	return q.Jitter().Seconds()
+    }, "peer", peer)
+    stats.CounterFunc("keepalive_lost_total", func() float64 {
+	return float64(q.Lost())
+    }, "peer", peer)
+}
+
+func (q *Quality)unregister(peer string) {
+    stats.Remove("keepalive_rtt_seconds", "peer", peer)
+    stats.Remove("keepalive_jitter_seconds", "peer", peer)
+    stats.Remove("keepalive_lost_total", "peer", peer)
+}
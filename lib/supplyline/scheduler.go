@@ -0,0 +1,154 @@
+// HTTP frontline / lib/supplyline
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package supplyline
+
+import (
+    "sync"
+
+    "frontline/lib/msg"
+)
+
+// Quantum is the number of bytes a connection with priority 1 may send in
+// one deficit round robin round.
+const Quantum = msg.LocalBufferSize + 8
+
+type schedQueue struct {
+    cmds [][]byte
+    deficit int
+    active bool
+}
+
+// Scheduler sits between the Connection goroutines and the link writer.
+// Control commands go first, data is sent deficit round robin across
+// connection ids, weighted by connection priority.
+type Scheduler struct {
+    mu sync.Mutex
+    cond *sync.Cond
+    ctrl [][]byte
+    queues [256]schedQueue
+    active []int
+    visited bool
+    priority func(id int) int
+    closed bool
+}
+
+func NewScheduler(priority func(id int) int) *Scheduler {
+    s := &Scheduler{
+	priority: priority,
+    }
+    s.cond = sync.NewCond(&s.mu)
+    return s
+}
+
+// Push queues a packed command, it never blocks. Connection.Run bounds
+// each connection to a window of DataCommands and the DataAcks for the
+// window of the peer, so one busy connection cannot hold up the others.
+func (s *Scheduler)Push(cmd []byte) {
+    if len(cmd) == 0 {
+	return
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.closed {
+	return
+    }
+    id := msg.PackedCommandId(cmd)
+    if id < 0 {
+	s.ctrl = append(s.ctrl, cmd)
+	s.cond.Broadcast()
+	return
+    }
+    q := &s.queues[id]
+    // control commands overtake data unless it would reorder the connection
+    if msg.IsControlCommand(cmd) && len(q.cmds) == 0 {
+	s.ctrl = append(s.ctrl, cmd)
+	s.cond.Broadcast()
+	return
+    }
+    q.cmds = append(q.cmds, cmd)
+    if !q.active {
+	q.active = true
+	s.active = append(s.active, id)
+    }
+    s.cond.Broadcast()
+}
+
+func (s *Scheduler)weight(id int) int {
+    w := 1
+    if s.priority != nil {
+	w = s.priority(id)
+    }
+    if w < 1 {
+	w = 1
+    }
+    return w
+}
+
+func (s *Scheduler)next() []byte {
+    if len(s.ctrl) > 0 {
+	cmd := s.ctrl[0]
+	s.ctrl = s.ctrl[1:]
+	return cmd
+    }
+    for len(s.active) > 0 {
+	id := s.active[0]
+	q := &s.queues[id]
+	if !s.visited {
+	    q.deficit += Quantum * s.weight(id)
+	    s.visited = true
+	}
+	if len(q.cmds[0]) <= q.deficit {
+	    cmd := q.cmds[0]
+	    q.cmds = q.cmds[1:]
+	    q.deficit -= len(cmd)
+	    if len(q.cmds) == 0 {
+		q.cmds = nil
+		q.deficit = 0
+		q.active = false
+		s.active = s.active[1:]
+		s.visited = false
+	    }
+	    return cmd
+	}
+	// move to the tail
+	s.active = append(s.active[1:], id)
+	s.visited = false
+    }
+    return nil
+}
+
+// Pop blocks until a command is ready to be sent. It returns false once the
+// scheduler is closed.
+func (s *Scheduler)Pop() ([]byte, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for {
+	if s.closed {
+	    return nil, false
+	}
+	if cmd := s.next(); cmd != nil {
+	    s.cond.Broadcast()
+	    return cmd, true
+	}
+	s.cond.Wait()
+    }
+}
+
+// Len returns the number of queued commands.
+func (s *Scheduler)Len() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    n := len(s.ctrl)
+    for _, id := range s.active {
+	n += len(s.queues[id].cmds)
+    }
+    return n
+}
+
+func (s *Scheduler)Close() {
+    s.mu.Lock()
+    s.closed = true
+    s.cond.Broadcast()
+    s.mu.Unlock()
+}
@@ -0,0 +1,80 @@
+// HTTP frontline / lib/supplyline
+// MIT License Copyright(c) 2020 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+package supplyline
+
+import (
+    "reflect"
+    "testing"
+
+    "frontline/lib/msg"
+)
+
+// popIds pops n commands and returns their connection ids, -1 for the link.
+func popIds(t *testing.T, s *Scheduler, n int) []int {
+    ids := []int{}
+    for i := 0; i < n; i++ {
+	cmd, ok := s.Pop()
+	if !ok {
+	    t.Fatalf("closed after %d commands", i)
+	}
+	ids = append(ids, msg.PackedCommandId(cmd))
+    }
+    return ids
+}
+
+func TestSchedulerControlFirst(t *testing.T) {
+    s := NewScheduler(nil)
+    data := make([]byte, msg.LocalBufferSize)
+    s.Push(msg.PackedDataCommand(1, 0, data))
+    s.Push(msg.PackedDataCommand(1, 1, data))
+    s.Push(msg.PackedDisconnectCommand(1))
+    s.Push(msg.PackedKeepaliveCommand())
+    s.Push(msg.PackedDisconnectCommand(2))
+    cmd, _ := s.Pop()
+    if c, _ := msg.ParseCommand(cmd); c.Name() != "KeepaliveCommand" {
+	t.Fatalf("first %s", c.Name())
+    }
+    // the disconnect of 1 stays behind its data
+    if got, want := popIds(t, s, 4), []int{ 2, 1, 1, 1 }; !reflect.DeepEqual(got, want) {
+	t.Errorf("got %v, want %v", got, want)
+    }
+    if n := s.Len(); n != 0 {
+	t.Errorf("%d left", n)
+    }
+}
+
+func TestSchedulerRoundRobin(t *testing.T) {
+    s := NewScheduler(func(id int) int {
+	if id == 3 {
+	    return 2
+	}
+	return 1
+    })
+    data := make([]byte, msg.LocalBufferSize)
+    for _, id := range []int{ 1, 2, 3 } {
+	for seq := 0; seq < 4; seq++ {
+	    s.Push(msg.PackedDataCommand(id, seq, data))
+	}
+    }
+    // one full command a round, two for priority 2
+    want := []int{ 1, 2, 3, 3, 1, 2, 3, 3, 1, 2, 1, 2 }
+    if got := popIds(t, s, len(want)); !reflect.DeepEqual(got, want) {
+	t.Errorf("got %v, want %v", got, want)
+    }
+}
+
+func TestSchedulerClose(t *testing.T) {
+    s := NewScheduler(nil)
+    s.Close()
+    if _, ok := s.Pop(); ok {
+	t.Errorf("Pop after Close")
+    }
+    // nothing is queued on a closed link
+    s.Push(msg.PackedKeepaliveCommand())
+    s.Push(msg.PackedDisconnectCommand(1))
+    s.Push(msg.PackedDataCommand(2, 0, []byte("data")))
+    if n := s.Len(); n != 0 {
+	t.Errorf("%d queued after Close", n)
+    }
+}
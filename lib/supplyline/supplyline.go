@@ -6,12 +6,54 @@ package supplyline
 import (
     "fmt"
     "net"
+    "sync"
     "time"
 
     "frontline/lib/msg"
     "frontline/lib/log"
+    "frontline/lib/stats"
 )
 
+func init() {
+    stats.Help("links_up", "Supply lines currently established.")
+    stats.Help("links_total", "Supply lines established.")
+    stats.Help("link_bytes_total", "Bytes sent (tx) and received (rx) on supply lines.")
+    stats.Help("queue_length", "Commands waiting in supply line queues.")
+}
+
+// Keepalive is the keepalive setting of a supply line. Main takes it when
+// the link starts, a running link keeps it until it ends.
+type Keepalive struct {
+    // interval of keepalive commands
+    Interval time.Duration
+    // keepalives lost in a row before the link is considered dead
+    MaxLost int
+    // time without any received command before the link is considered dead
+    DeadTimeout time.Duration
+}
+
+var (
+    keepaliveLock sync.Mutex
+    keepalive = Keepalive{ Interval: time.Minute, MaxLost: 2, DeadTimeout: time.Minute * 2 }
+)
+
+// SetKeepalive sets the keepalive of the supply lines started from now.
+func SetKeepalive(k Keepalive) {
+    keepaliveLock.Lock()
+    defer keepaliveLock.Unlock()
+    keepalive = k
+}
+
+// legacyDeadTimeout is the least dead timeout for a peer without caps, it
+// sends a keepalive every minute whatever is set here.
+const legacyDeadTimeout = time.Minute * 2
+
+func currentKeepalive() Keepalive {
+    keepaliveLock.Lock()
+    defer keepaliveLock.Unlock()
+    return keepalive
+}
+
 func writeall(conn net.Conn, cmd []byte) error {
     n := 0
     for n < len(cmd) {
@@ -24,52 +66,136 @@ func writeall(conn net.Conn, cmd []byte) error {
     return nil
 }
 
+// Prioritizer may be implemented by the CommandHandler to give connections
+// a larger share of the link.
+type Prioritizer interface {
+    Priority(connId int) int
+}
+
 func Main(conn net.Conn, h msg.CommandHandler, q_req chan []byte) {
-    tag := log.NewTag("Unknown")
+    peer := "Unknown"
     if tcp, ok := conn.(*net.TCPConn); ok {
-	tag = log.NewTag(fmt.Sprintf("%v", tcp.RemoteAddr()))
+	peer = fmt.Sprintf("%v", tcp.RemoteAddr())
     }
+    tag := log.NewTag("link", "peer", peer)
+    katag := log.NewTag("keepalive", "peer", peer)
 
-    ticker := time.NewTicker(time.Minute)
+    stats.Counter("links_total").Inc()
+    up := stats.Gauge("links_up")
+    up.Inc()
+    defer up.Dec()
+    tx := stats.Counter("link_bytes_total", "direction", "tx")
+    quality := &Quality{}
+    quality.register(peer)
+    defer quality.unregister(peer)
+
+    ka := currentKeepalive()
+    ticker := time.NewTicker(ka.Interval)
     defer ticker.Stop()
 
+    var priority func(int) int
+    if p, ok := h.(Prioritizer); ok {
+	priority = p.Priority
+    }
+    sched := NewScheduler(priority)
+    defer sched.Close()
+
     running := true
+    q_err := make(chan error, 1)
+    // start writer
+    go func() {
+	for {
+	    cmd, ok := sched.Pop()
+	    if !ok {
+		return
+	    }
+	    tag.Debugf("send %d bytes", len(cmd))
+	    if err := writeall(conn, cmd); err != nil {
+		q_err <- err
+		return
+	    }
+	    tx.Add(int64(len(cmd)))
+	}
+    }()
+    // feed the scheduler
+    q_done := make(chan bool)
+    defer close(q_done)
+    go func() {
+	for {
+	    select {
+	    case cmd := <-q_req:
+		sched.Push(cmd)
+	    case <-q_done:
+		return
+	    }
+	}
+    }()
     q_recv := make(chan msg.Command, 256)
-    q_wait := make(chan bool, 256)
+    queues := map[string]func() float64{
+	"q_req": func() float64 { return float64(len(q_req)) },
+	"q_recv": func() float64 { return float64(len(q_recv)) },
+	"sched": func() float64 { return float64(sched.Len()) },
+    }
+    for name, f := range queues {
+	stats.GaugeFunc("queue_length", f, "peer", peer, "queue", name)
+	defer stats.Remove("queue_length", "peer", peer, "queue", name)
+    }
     // start receiver
     go func() {
-	err := msg.Receiver(conn, q_recv, q_wait, &running)
-	tag.Printf("Receiver: %v\n", err)
-	close(q_wait)
+	err := msg.Receiver(conn, q_recv, &running)
+	tag.Printf("Receiver: %v", err)
     }()
+    // what the peer advertised in LinkCommand
+    caps := 0
     lastrecv := time.Now()
     for running {
 	select {
 	case cmd, ok := <-q_recv:
 	    if !ok {
-		tag.Printf("q_recv closed\n")
+		tag.Printf("q_recv closed")
 		running = false
 		break
 	    }
-	    //tag.Printf("recv %s\n", cmd.Name())
+	    tag.Debugf("recv %s", cmd.Name())
+	    switch cmd := cmd.(type) {
+	    case *msg.LinkCommand:
+		caps = cmd.Caps
+	    case *msg.KeepaliveCommand:
+		if caps & msg.CapKeepaliveAck != 0 {
+		    sched.Push(msg.PackedKeepaliveAckCommand(cmd))
+		}
+	    case *msg.KeepaliveAckCommand:
+		quality.Ack(cmd.T)
+	    }
 	    msg.HandleCommand(h, cmd)
-	    q_wait <- true
 	    lastrecv = time.Now()
-	case cmd := <-q_req:
-	    //tag.Printf("send %d bytes\n", len(cmd))
-	    if err := writeall(conn, cmd); err != nil {
-		tag.Printf("write cmd: %v\n", err)
+	case err := <-q_err:
+	    tag.Errorf("write cmd: %v", err)
+	    running = false
+	case <-ticker.C:
+	    // keep alive, an old peer does not echo it
+	    echo := caps & msg.CapKeepaliveAck != 0
+	    if echo && quality.Missed() > 0 {
+		katag.Warnf("keep alive lost, last recv %v ago", time.Since(lastrecv).Round(time.Second))
+	    }
+	    now := time.Now()
+	    if echo {
+		quality.Sent(now)
+	    }
+	    sched.Push(msg.PackedKeepaliveCommandAt(now))
+	    dead := ka.DeadTimeout
+	    if caps == 0 && dead < legacyDeadTimeout {
+		dead = legacyDeadTimeout
+	    }
+	    if (echo && quality.Missed() >= ka.MaxLost) || time.Since(lastrecv) > dead {
+		tag.Warnf("keep alive failed (%s)", quality)
 		running = false
 		break
 	    }
-	case <-ticker.C:
-	    // keep alive
-	    q_req <- msg.PackedKeepaliveCommand()
-	    if time.Now().After(lastrecv.Add(time.Minute * 2)) {
-		tag.Printf("keep alive failed\n")
-		running = false
+	    if !echo {
 		break
 	    }
+	    katag.With("rtt", quality.RTT(), "jitter", quality.Jitter(), "lost", quality.Lost()).Printf("link quality")
 	}
     }
 }